@@ -0,0 +1,214 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "path"
+    "sort"
+    "time"
+    "strings"
+    "golang.org/x/crypto/ssh"
+)
+
+func containsString(list []string, v string) bool {
+    for _, e := range list {
+        if e == v {
+            return true
+        }
+    }
+    return false
+}
+
+func appendUnique(list []string, v string) []string {
+    if containsString(list, v) {
+        return list
+    }
+    return append(list, v)
+}
+
+// Returns the names of the ACLs granted to a user, the ACL configured for
+// the user followed by any resolved at auth time (e.g. from directory group
+// membership), regardless of where or when the user is connecting.
+func grantedACLs(c *SSHConfig, username string, perm *ssh.Permissions) []string {
+    var acls []string
+
+    if user, ok := c.Users[username]; ok && len(user.ACL) > 0 {
+        acls = append(acls, user.ACL)
+    }
+
+    if perm != nil && len(perm.Extensions["acls"]) > 0 {
+        for _, acl := range strings.Split(perm.Extensions["acls"], ",") {
+            acls = appendUnique(acls, acl)
+        }
+    }
+
+    return acls
+}
+
+// Returns the ACLs granted to an authenticated connection, excluding those
+// with allowed_sources that don't match the connection's remote address and
+// those outside of their time window.
+func userACLs(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions) []string {
+    var acls []string
+    for _, name := range grantedACLs(c, conn.User(), perm) {
+        if acl, ok := c.ACLs[name]; ok {
+            if len(acl.AllowedSources) > 0 {
+                if err := checkSourceAddress(conn.RemoteAddr(), strings.Join(acl.AllowedSources, ",")); err != nil {
+                    continue
+                }
+            }
+            if err := acl.checkAt(time.Now()); err != nil {
+                continue
+            }
+        }
+        acls = append(acls, name)
+    }
+    return acls
+}
+
+// Returns the servers a connection may currently use, from its ACLs and any
+// granted directly at auth time (e.g. by the webhook). There are none while
+// the user is outside of their own time window.
+func permittedServers(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions) ([]string, error) {
+    if user, ok := c.Users[conn.User()]; ok {
+        if err := user.checkAt(time.Now()); err != nil {
+            return nil, nil
+        }
+    }
+
+    var servers []string
+    for _, name := range userACLs(c, conn, perm) {
+        acl, ok := c.ACLs[name]
+        if ! ok {
+            return nil, fmt.Errorf("Invalid ACL (%s)", name)
+        }
+        for _, svr := range aclServers(c, acl) {
+            servers = appendUnique(servers, svr)
+        }
+    }
+
+    if perm != nil && len(perm.Extensions["allowed_servers"]) > 0 {
+        for _, svr := range strings.Split(perm.Extensions["allowed_servers"], ",") {
+            servers = appendUnique(servers, svr)
+        }
+    }
+
+    return servers, nil
+}
+
+// Applies the user and ACL allowed_sources and time window restrictions after
+// a successful authentication. A user whose ACLs are all restricted to other
+// sources or times is refused at login rather than at server selection.
+func authorizeConn(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions, err error) (*ssh.Permissions, error) {
+    if err != nil {
+        return perm, err
+    }
+
+    if user, ok := c.Users[conn.User()]; ok {
+        if len(user.AllowedSources) > 0 {
+            if err := checkSourceAddress(conn.RemoteAddr(), strings.Join(user.AllowedSources, ",")); err != nil {
+                WriteAuthLog("Refused user %s from %s: %s", conn.User(), conn.RemoteAddr(), err)
+                return nil, fmt.Errorf("User Not Permitted From Source Address")
+            }
+        }
+        if err := user.checkAt(time.Now()); err != nil {
+            WriteAuthLog("Refused user %s from %s: %s", conn.User(), conn.RemoteAddr(), err)
+            return nil, fmt.Errorf("User Not Permitted At This Time")
+        }
+    }
+
+    if len(grantedACLs(c, conn.User(), perm)) > 0 && len(userACLs(c, conn, perm)) == 0 {
+        WriteAuthLog("Refused user %s from %s: no ACLs permitted from source address or at this time", conn.User(), conn.RemoteAddr())
+        return nil, fmt.Errorf("No ACLs Permitted From Source Address Or At This Time")
+    }
+
+    return perm, nil
+}
+
+// Returns whether a server matches an allow_list / deny_list rule, which is
+// either "tag:key=value" (or "tag:key" for any value), or a server name that
+// may contain * and ? wildcards (e.g. "web-*.prod").
+func matchServerRule(rule string, name string, server SSHConfigServer) bool {
+    if strings.HasPrefix(rule, "tag:") {
+        parts := strings.SplitN(strings.TrimPrefix(rule, "tag:"), "=", 2)
+        value, ok := server.Tags[parts[0]]
+        if ! ok {
+            return false
+        }
+        if len(parts) == 1 {
+            return true
+        }
+        match, _ := path.Match(parts[1], value)
+        return match
+    }
+
+    match, _ := path.Match(rule, name)
+    return match
+}
+
+// Resolves an ACL to the names of the servers it allows, in allow_list order
+// (servers matched by the same wildcard or tag rule are sorted by name),
+// less those matched by its deny_list.
+func aclServers(c *SSHConfig, acl SSHConfigACL) []string {
+    var names []string
+    for name := range c.Servers {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var servers []string
+    for _, rule := range acl.AllowedServers {
+        for _, name := range names {
+            if ! matchServerRule(rule, name, c.Servers[name]) {
+                continue
+            }
+
+            denied := false
+            for _, deny := range acl.DeniedServers {
+                if matchServerRule(deny, name, c.Servers[name]) {
+                    denied = true
+                    break
+                }
+            }
+            if ! denied {
+                servers = appendUnique(servers, name)
+            }
+        }
+    }
+
+    return servers
+}
+
+// Matches an address against an OpenSSH style pattern list, as used by the
+// from="" authorized_keys option. Patterns may be addresses with * and ?
+// wildcards or CIDR ranges, and a pattern prefixed with ! denies the address
+// even if another pattern matches. Hostnames aren't resolved, so only
+// address patterns can match.
+func matchSourcePatterns(addr net.Addr, patterns string) bool {
+    ip := net.ParseIP(remoteIP(addr))
+    if ip == nil {
+        return false
+    }
+
+    matched := false
+    for _, pattern := range strings.Split(patterns, ",") {
+        pattern = strings.TrimSpace(pattern)
+        negated := strings.HasPrefix(pattern, "!")
+        pattern = strings.TrimPrefix(pattern, "!")
+
+        var match bool
+        if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+            match = ipNet.Contains(ip)
+        } else {
+            match, _ = path.Match(strings.ToLower(pattern), ip.String())
+        }
+
+        if match && negated {
+            return false
+        } else if match {
+            matched = true
+        }
+    }
+
+    return matched
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "bytes"
+    "context"
+    "strconv"
+    "strings"
+    "syscall"
+    "os/exec"
+    "os/user"
+    "encoding/base64"
+    "golang.org/x/crypto/ssh"
+)
+
+const (
+    defaultAuthorizedKeysCommandTimeout = 5 * time.Second
+    defaultAuthorizedKeysCommandCache   = 1 * time.Minute
+)
+
+type authorizedKeysCacheEntry struct {
+    output      []byte
+    expires     time.Time
+}
+
+var authorizedKeysCache = map[string]*authorizedKeysCacheEntry{}
+var authorizedKeysCacheMutex = &sync.Mutex{}
+
+// Expands the sshd style tokens in an authorized_keys_command argument,
+// %u username, %t key type, %f SHA256 fingerprint, %k base64 key and %% a literal %.
+func expandAuthorizedKeysToken(arg string, username string, key ssh.PublicKey) string {
+    r := strings.NewReplacer(
+        "%%", "%",
+        "%u", username,
+        "%t", key.Type(),
+        "%f", ssh.FingerprintSHA256(key),
+        "%k", base64.StdEncoding.EncodeToString(key.Marshal()),
+    )
+    return r.Replace(arg)
+}
+
+func authorizedKeysCommandArgs(c *SSHConfig, username string, key ssh.PublicKey) []string {
+    fields := strings.Fields(c.Global.AuthorizedKeysCommand)
+
+    // Without any tokens, pass the username, key type and fingerprint.
+    if ! strings.Contains(c.Global.AuthorizedKeysCommand, "%") {
+        fields = append(fields, "%u", "%t", "%f")
+    }
+
+    args := make([]string, len(fields))
+    for i, field := range fields {
+        args[i] = expandAuthorizedKeysToken(field, username, key)
+    }
+    return args
+}
+
+func authorizedKeysCommandCredential(c *SSHConfig) (*syscall.Credential, error) {
+    if len(c.Global.AuthorizedKeysCommandUser) == 0 {
+        return nil, nil
+    }
+
+    u, err := user.Lookup(c.Global.AuthorizedKeysCommandUser)
+    if err != nil {
+        return nil, fmt.Errorf("Unknown authorized_keys_command_user (%s): %s", c.Global.AuthorizedKeysCommandUser, err)
+    }
+
+    uid, err := strconv.ParseUint(u.Uid, 10, 32)
+    if err != nil {
+        return nil, err
+    }
+    gid, err := strconv.ParseUint(u.Gid, 10, 32)
+    if err != nil {
+        return nil, err
+    }
+
+    return &syscall.Credential{ Uid: uint32(uid), Gid: uint32(gid) }, nil
+}
+
+// Runs the authorized_keys_command for a user and key, returning its output
+// in authorized_keys format. Output is cached per user and key fingerprint.
+func runAuthorizedKeysCommand(c *SSHConfig, username string, key ssh.PublicKey) ([]byte, error) {
+    cacheTime, err := parseDurationOption("authorized_keys_command_cache", c.Global.AuthorizedKeysCommandCache, defaultAuthorizedKeysCommandCache)
+    if err != nil {
+        return nil, err
+    }
+    timeout, err := parseDurationOption("authorized_keys_command_timeout", c.Global.AuthorizedKeysCommandTimeout, defaultAuthorizedKeysCommandTimeout)
+    if err != nil {
+        return nil, err
+    }
+
+    cacheKey := username + " " + ssh.FingerprintSHA256(key)
+
+    authorizedKeysCacheMutex.Lock()
+    now := time.Now()
+    for k, entry := range authorizedKeysCache {
+        if now.After(entry.expires) {
+            delete(authorizedKeysCache, k)
+        }
+    }
+    if entry, ok := authorizedKeysCache[cacheKey]; ok {
+        authorizedKeysCacheMutex.Unlock()
+        return entry.output, nil
+    }
+    authorizedKeysCacheMutex.Unlock()
+
+    args := authorizedKeysCommandArgs(c, username, key)
+    if len(args) == 0 {
+        return nil, fmt.Errorf("Empty authorized_keys_command")
+    }
+
+    credential, err := authorizedKeysCommandCredential(c)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+    cmd.Env = []string{ "PATH=/usr/bin:/bin:/usr/sbin:/sbin" }
+    if credential != nil {
+        cmd.SysProcAttr = &syscall.SysProcAttr{ Credential: credential }
+    }
+
+    var stderr bytes.Buffer
+    cmd.Stderr = &stderr
+
+    output, err := cmd.Output()
+    if ctx.Err() == context.DeadlineExceeded {
+        return nil, fmt.Errorf("authorized_keys_command timed out after %s", timeout)
+    } else if err != nil {
+        log.Printf("authorized_keys_command for user (%s) failed: %s: %s", username, err, strings.TrimSpace(stderr.String()))
+        return nil, fmt.Errorf("authorized_keys_command failed: %s", err)
+    }
+
+    if cacheTime > 0 {
+        authorizedKeysCacheMutex.Lock()
+        authorizedKeysCache[cacheKey] = &authorizedKeysCacheEntry{
+            output:     output,
+            expires:    time.Now().Add(cacheTime),
+        }
+        authorizedKeysCacheMutex.Unlock()
+    }
+
+    return output, nil
+}
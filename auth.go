@@ -3,19 +3,15 @@ package main
 import (
     "fmt"
     "log"
+    "io/ioutil"
     "golang.org/x/crypto/ssh"
-    ldap "github.com/tonnerre/go-ldap"
 )
 
-func AuthUserPass(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-    perm := &ssh.Permissions{
-        Extensions: map[string]string{
-            "authType":     "password",
-            "password":     string(password),
-        },
-    }
-
-    if _, ok := config.Users[conn.User()]; ! ok {
+func AuthUserPass(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+    // Users not listed in the config may still log in through group_acls,
+    // or with servers granted by the webhook.
+    _, known := c.Users[conn.User()]
+    if ! known && len(c.GroupACLs) == 0 && ! webhookConfigured(c) {
         return nil, fmt.Errorf("User Doesn't Exist in Config")
     }
     
@@ -24,20 +20,83 @@ func AuthUserPass(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, err
         return nil, fmt.Errorf("Blank Password Not Allowed")
     }
 
-    if config.Global.AuthType == "ad" {
-        l, err := ldap.Dial("tcp", config.Global.LDAP_Server)
-        if err != nil {
-            log.Printf("LDAP Connect Failed: %s", err)
-            return nil, fmt.Errorf("LDAP Connect Failed: %s", err)
+    return runAuthenticators(c, conn, password, c.Global.AuthType, map[string]string{}, false)
+}
+
+// Builds the permissions for a successful password authentication from the
+// extensions resolved by the auth backends.
+func userPassPermissions(c *SSHConfig, conn ssh.ConnMetadata, password []byte, extensions map[string]string) (*ssh.Permissions, error) {
+    perm := &ssh.Permissions{
+        Extensions: map[string]string{},
+    }
+    for k, v := range extensions {
+        perm.Extensions[k] = v
+    }
+    perm.Extensions["authType"] = "password"
+
+    if _, known := c.Users[conn.User()]; ! known && len(perm.Extensions["acls"]) == 0 && len(perm.Extensions["allowed_servers"]) == 0 {
+        return nil, fmt.Errorf("User Doesn't Exist in Config or Mapped Groups")
+    }
+
+    // Only keep the password if it is to be passed through to the remote.
+    if c.Global.PassPassword {
+        credentials.Put(conn.SessionID(), password)
+    }
+
+    return perm, nil
+}
+
+func AuthPublicKey(c *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    if isKeyRevoked(c, key) {
+        log.Printf("Revoked key (%s) offered by user (%s)", ssh.FingerprintSHA256(key), conn.User())
+        return nil, fmt.Errorf("Key Revoked - ACCESS DENIED")
+    }
+
+    perm, err := authConfigPublicKey(c, conn, key)
+    if err == nil || ! c.Global.WebhookPublicKey || len(c.Global.WebhookURL) == 0 {
+        return perm, err
+    }
+
+    // Plain keys not accepted by the config may still be accepted by the webhook.
+    if _, ok := key.(*ssh.Certificate); ok {
+        return perm, err
+    }
+    return authWebhookPublicKey(c, conn, key)
+}
+
+// Checks a key against the user's authorized keys or trusted CAs.
+func authConfigPublicKey(c *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    if user, ok := c.Users[conn.User()]; ! ok {
+        return nil, fmt.Errorf("User Not Found in Config for PK")
+    } else {
+        if cert, ok := key.(*ssh.Certificate); ok {
+            return AuthCertificate(c, conn, cert)
         }
 
-        if err := l.Bind(fmt.Sprintf("%s@%s", conn.User(), config.Global.LDAP_Domain), string(password)); err != nil {
-            log.Printf("LDAP Bind Failed: %s", err)
-            return nil, fmt.Errorf("LDAP Bind Failed: %s", err)
+        if len(user.AuthorizedKeysFile) == 0 && len(c.Global.AuthorizedKeysCommand) == 0 {
+            return nil, fmt.Errorf("User has not authorized keys file specified.")
         }
 
-        return perm, nil
-    } else {
-        return nil, fmt.Errorf("No Valid Auth Types")
+        if len(user.AuthorizedKeysFile) > 0 {
+            authKeysData, err := ioutil.ReadFile(user.AuthorizedKeysFile)
+            if err != nil {
+                log.Printf("Unable to read authorized keys file (%s) for user (%s): %s.", user.AuthorizedKeysFile, conn.User(), err)
+                return nil, fmt.Errorf("Unable to read Authorized Keys file.")
+            }
+
+            perm, err := matchAuthorizedKeys(conn, key, authKeysData, user.AuthorizedKeysFile)
+            if err == nil || len(c.Global.AuthorizedKeysCommand) == 0 {
+                return perm, err
+            }
+        }
+
+        // Fall back to looking up keys externally (e.g. from LDAP or an inventory system).
+        authKeysData, err := runAuthorizedKeysCommand(c, conn.User(), key)
+        if err != nil {
+            log.Printf("Unable to look up authorized keys for user (%s): %s", conn.User(), err)
+            return nil, fmt.Errorf("Unable to look up Authorized Keys.")
+        }
+
+        return matchAuthorizedKeys(conn, key, authKeysData, "authorized_keys_command")
     }
 }
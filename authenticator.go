@@ -0,0 +1,168 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "gopkg.in/yaml.v2"
+    "golang.org/x/crypto/ssh"
+)
+
+// An Authenticator checks a user's password against a backend, returning
+// the ssh.Permissions extensions it resolved for the user (e.g. "acls").
+// It is given the config taken at the start of the auth callback, so that a
+// reload part way through can't mix settings from two configs.
+type Authenticator interface {
+    Authenticate(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error)
+}
+
+type AuthenticatorFunc func(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error)
+
+func (f AuthenticatorFunc) Authenticate(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    return f(c, conn, password)
+}
+
+// Returned by an Authenticator that needs a further response from the user
+// (e.g. a RADIUS Access-Challenge), which is asked for via keyboard-interactive.
+type AuthChallenge interface {
+    error
+    Respond(c *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (map[string]string, error)
+}
+
+var authenticators = map[string]Authenticator{}
+
+// Makes a backend available by name for use in auth_type.
+func RegisterAuthenticator(name string, a Authenticator) {
+    authenticators[name] = a
+}
+
+// The global settings each backend type may override, by key prefix.
+var backendSettingPrefixes = map[string]string{
+    "ad":       "ldap_",
+    "ldap":     "ldap_",
+    "radius":   "radius_",
+    "local":    "local_",
+    "webhook":  "webhook_",
+}
+
+// Returns the config a backend runs with, the globals with the backend's own
+// settings applied over them.
+func backendConfig(c *SSHConfig, backend SSHConfigAuthBackend) (*SSHConfig, error) {
+    if len(backend.Settings) == 0 {
+        return c, nil
+    }
+
+    config := *c
+    prefix := backendSettingPrefixes[backend.Type]
+    for key, value := range backend.Settings {
+        // webhook_public_key is for public key auth, not the password backend.
+        if len(prefix) == 0 || ! strings.HasPrefix(key, prefix) || key == "webhook_public_key" {
+            return nil, fmt.Errorf("Setting %s can't be set for auth_type %s", key, backend.Type)
+        }
+
+        data, err := yaml.Marshal(map[string]interface{}{ key: value })
+        if err == nil {
+            err = yaml.UnmarshalStrict(data, &config.Global)
+        }
+        if typeErr, ok := err.(*yaml.TypeError); ok {
+            // Line numbers would be those of the marshalled setting.
+            message := typeErr.Errors[0]
+            if parts := strings.SplitN(message, ": ", 2); len(parts) == 2 && strings.HasPrefix(parts[0], "line ") {
+                message = parts[1]
+            }
+            err = fmt.Errorf("%s", message)
+        }
+        if err != nil {
+            return nil, fmt.Errorf("Invalid %s for auth_type %s: %s", key, backend.Type, err)
+        }
+    }
+    return &config, nil
+}
+
+// Merges extensions resolved by a backend, ACL and server lists are combined
+// while other values from earlier backends take precedence.
+func mergeExtensions(extensions map[string]string, resolved map[string]string) {
+    for k, v := range resolved {
+        if ( k == "acls" || k == "allowed_servers" ) && len(extensions[k]) > 0 {
+            acls := strings.Split(extensions[k], ",")
+            for _, acl := range strings.Split(v, ",") {
+                acls = appendUnique(acls, acl)
+            }
+            extensions[k] = strings.Join(acls, ",")
+        } else if _, ok := extensions[k]; ! ok {
+            extensions[k] = v
+        }
+    }
+}
+
+// Runs the configured backends in order. With auth_mode "any" the first
+// success is enough (as well as any backends marked required), with "all"
+// every backend must succeed. A backend challenge suspends the chain until
+// the user responds through keyboard-interactive auth.
+func runAuthenticators(c *SSHConfig, conn ssh.ConnMetadata, password []byte, backends []SSHConfigAuthBackend, extensions map[string]string, passed bool) (*ssh.Permissions, error) {
+    requireAll := c.Global.AuthMode == "all"
+
+    var lastErr error
+    for i, backend := range backends {
+        required := requireAll || backend.Required
+        if backend.Type == "none" || ( passed && ! required ) {
+            continue
+        }
+
+        a, ok := authenticators[backend.Type]
+        if ! ok {
+            log.Printf("Unknown auth type (%s) configured", backend.Type)
+            lastErr = fmt.Errorf("No Valid Auth Types")
+            if required {
+                return nil, lastErr
+            }
+            continue
+        }
+
+        bc, err := backendConfig(c, backend)
+        if err != nil {
+            log.Printf("%s", err)
+            lastErr = fmt.Errorf("No Valid Auth Types")
+            if required {
+                return nil, lastErr
+            }
+            continue
+        }
+
+        resolved, err := a.Authenticate(bc, conn, password)
+        if challenge, ok := err.(AuthChallenge); ok {
+            remaining := backends[i+1:]
+            return nil, &ssh.PartialSuccessError{
+                Next: ssh.ServerAuthCallbacks{
+                    KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+                        resolved, err := challenge.Respond(bc, conn, client)
+                        if err != nil {
+                            return nil, err
+                        }
+                        mergeExtensions(extensions, resolved)
+                        return runAuthenticators(c, conn, password, remaining, extensions, true)
+                    },
+                },
+            }
+        }
+        if err != nil {
+            if required {
+                return nil, err
+            }
+            lastErr = err
+            continue
+        }
+
+        mergeExtensions(extensions, resolved)
+        passed = true
+    }
+
+    if ! passed {
+        if lastErr == nil {
+            lastErr = fmt.Errorf("No Valid Auth Types")
+        }
+        return nil, lastErr
+    }
+
+    return userPassPermissions(c, conn, password, extensions)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+    "net"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "gopkg.in/yaml.v2"
+    "golang.org/x/crypto/ssh"
+)
+
+type testConnMetadata struct {
+    ssh.ConnMetadata
+    user        string
+}
+
+func (c testConnMetadata) User() string {
+    return c.user
+}
+
+func (c testConnMetadata) RemoteAddr() net.Addr {
+    return &net.TCPAddr{ IP: net.ParseIP("192.0.2.1"), Port: 50000 }
+}
+
+func parseTestConfig(t *testing.T, data string) *SSHConfig {
+    c := &SSHConfig{}
+    if err := yaml.Unmarshal([]byte(data), c); err != nil {
+        t.Fatal(err)
+    }
+    return c
+}
+
+func TestBackendConfig(t *testing.T) {
+    c := parseTestConfig(t, `
+global:
+    ldap_server: "dc1.example.com"
+    ldap_domain: "example.com"
+    auth_type:
+        - "ad"
+        - type: "ad"
+          ldap_server: "dc2.example.com"
+          ldap_tls: "ldaps"
+`)
+
+    first, err := backendConfig(c, c.Global.AuthType[0])
+    if err != nil || first != c {
+        t.Errorf("Expected a backend without settings to use the config, got %v", err)
+    }
+
+    second, err := backendConfig(c, c.Global.AuthType[1])
+    if err != nil {
+        t.Fatal(err)
+    }
+    if second.Global.LDAP_Server != "dc2.example.com" || second.Global.LDAP_TLS != "ldaps" || second.Global.LDAP_Domain != "example.com" {
+        t.Errorf("Expected the backend settings over the globals, got %+v", second.Global)
+    }
+    if c.Global.LDAP_Server != "dc1.example.com" || len(c.Global.LDAP_TLS) > 0 {
+        t.Errorf("Expected the globals to be unchanged, got %+v", c.Global)
+    }
+}
+
+func TestBackendConfigInvalid(t *testing.T) {
+    for name, backend := range map[string]SSHConfigAuthBackend{
+        "other type":       { Type: "ad", Settings: map[string]interface{}{ "radius_secret": "x" } },
+        "public key":       { Type: "webhook", Settings: map[string]interface{}{ "webhook_public_key": true } },
+        "unknown key":      { Type: "ldap", Settings: map[string]interface{}{ "ldap_servre": "x" } },
+        "wrong type":       { Type: "radius", Settings: map[string]interface{}{ "radius_retries": "many" } },
+        "no settings":      { Type: "none", Settings: map[string]interface{}{ "ldap_server": "x" } },
+    } {
+        if _, err := backendConfig(&SSHConfig{}, backend); err == nil {
+            t.Errorf("%s: expected an error", name)
+        }
+    }
+}
+
+// Each local backend checks its own password file.
+func TestRunAuthenticatorsBackendSettings(t *testing.T) {
+    dir := t.TempDir()
+    for name, user := range map[string]string{ "first": "alice", "second": "bob" } {
+        hash, err := hashArgon2id([]byte(user + "-secret"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(user + ":" + hash + "\n"), 0600); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    c := parseTestConfig(t, `
+global:
+    local_password_file: "` + filepath.Join(dir, "first") + `"
+    auth_type:
+        - "local"
+        - type: "local"
+          local_password_file: "` + filepath.Join(dir, "second") + `"
+users:
+    alice: {}
+    bob: {}
+`)
+
+    for _, user := range []string{ "alice", "bob" } {
+        if _, err := runAuthenticators(c, testConnMetadata{ user: user }, []byte(user + "-secret"), c.Global.AuthType, map[string]string{}, false); err != nil {
+            t.Errorf("%s: expected the password to be accepted, got %v", user, err)
+        }
+    }
+    if _, err := runAuthenticators(c, testConnMetadata{ user: "bob" }, []byte("alice-secret"), c.Global.AuthType, map[string]string{}, false); err == nil {
+        t.Errorf("Expected the wrong password to fail")
+    }
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "strings"
+    "golang.org/x/crypto/ssh"
+)
+
+// Searches authorized_keys data for the offered key, returning the
+// permissions from the options of the first matching entry that is valid
+// for this connection (not expired, permitted from the remote address).
+func matchAuthorizedKeys(conn ssh.ConnMetadata, key ssh.PublicKey, authKeysData []byte, source string) (*ssh.Permissions, error) {
+    for {
+        if len(authKeysData) > 0 {
+            var authKey ssh.PublicKey
+            var options []string
+            var err error
+            authKey, _, options, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
+            if err != nil {
+                log.Printf("Error while processing authorized keys (%s) for user (%s): %s", source, conn.User(), err)
+                return nil, fmt.Errorf("Error while processing authorized keys file.")
+            }
+
+            if ( key.Type() == authKey.Type() ) && ( bytes.Compare(key.Marshal(), authKey.Marshal()) == 0 ) {
+                perm, err := keyOptionPermissions(conn, options)
+                if err != nil {
+                    log.Printf("Key from (%s) for user (%s) not accepted: %s", source, conn.User(), err)
+                    continue
+                }
+                return perm, nil
+            }
+        } else {
+            return nil, fmt.Errorf("No PKs Match - ACCESS DENIED")
+        }
+    }
+}
+
+// Returns the value of an option from an authorized_keys entry, with any
+// quotes removed, and whether the option is present.
+func authorizedKeyOption(options []string, name string) (string, bool) {
+    for _, option := range options {
+        k := option
+        v := ""
+        if i := strings.Index(option, "="); i >= 0 {
+            k = option[:i]
+            v = strings.Trim(option[i+1:], "\"")
+        }
+
+        if strings.EqualFold(k, name) {
+            return v, true
+        }
+    }
+    return "", false
+}
+
+// Parses an expiry-time option, YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix.
+func parseExpiryTime(value string) (time.Time, error) {
+    loc := time.Local
+    if strings.HasSuffix(value, "Z") || strings.HasSuffix(value, "z") {
+        value = value[:len(value)-1]
+        loc = time.UTC
+    }
+
+    for _, layout := range []string{ "20060102", "200601021504", "20060102150405" } {
+        if len(value) == len(layout) {
+            return time.ParseInLocation(layout, value, loc)
+        }
+    }
+
+    return time.Time{}, fmt.Errorf("Invalid expiry-time (%s)", value)
+}
+
+// Features an authorized_keys entry can disable with no-* (or restrict, unless
+// re-enabled by name), recorded as extensions of the same no-* name.
+var keyOptionRestrictions = []string{
+    "agent-forwarding",
+    "port-forwarding",
+    "pty",
+    "X11-forwarding",
+}
+
+// Session requests refused when the extension for their restriction is set.
+var restrictedSessionRequests = map[string]string{
+    "auth-agent-req@openssh.com":   "no-agent-forwarding",
+    "pty-req":                      "no-pty",
+    "x11-req":                      "no-X11-forwarding",
+}
+
+// Returns whether a session request is refused by the restrictions of the key
+// or certificate used to authenticate.
+func sessionRequestDenied(perm *ssh.Permissions, reqType string) bool {
+    ext, ok := restrictedSessionRequests[reqType]
+    if ! ok || perm == nil {
+        return false
+    }
+    _, denied := perm.Extensions[ext]
+    return denied
+}
+
+// Converts the options of an authorized_keys entry into permissions, as
+// OpenSSH would apply them. command="" names the only server the key may
+// connect to (as force-command does for certificates), and forwarding and
+// pty restrictions are recorded as "no-*" extensions.
+func keyOptionPermissions(conn ssh.ConnMetadata, options []string) (*ssh.Permissions, error) {
+    perm := &ssh.Permissions{
+        CriticalOptions:    map[string]string{},
+        Extensions:         map[string]string{
+            "authType":         "pk",
+        },
+    }
+
+    if expiry, ok := authorizedKeyOption(options, "expiry-time"); ok {
+        expiryTime, err := parseExpiryTime(expiry)
+        if err != nil {
+            return nil, err
+        }
+        if time.Now().After(expiryTime) {
+            return nil, fmt.Errorf("Key expired at %s", expiryTime.Format(time.RFC3339))
+        }
+    }
+
+    if from, ok := authorizedKeyOption(options, "from"); ok && ! matchSourcePatterns(conn.RemoteAddr(), from) {
+        return nil, fmt.Errorf("Not permitted from %s by from=\"%s\"", conn.RemoteAddr(), from)
+    }
+
+    if command, ok := authorizedKeyOption(options, "command"); ok {
+        perm.CriticalOptions["force-command"] = command
+    }
+
+    // restrict disables everything, with agent-forwarding, pty etc. re-enabling.
+    _, restrict := authorizedKeyOption(options, "restrict")
+    for _, feature := range keyOptionRestrictions {
+        _, enabled := authorizedKeyOption(options, feature)
+        _, disabled := authorizedKeyOption(options, "no-" + feature)
+        if disabled || ( restrict && ! enabled ) {
+            perm.Extensions["no-" + feature] = ""
+        }
+    }
+
+    return perm, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "testing"
+    "golang.org/x/crypto/ssh"
+)
+
+func TestKeyOptionRestrictions(t *testing.T) {
+    conn := testConnMetadata{ user: "alice" }
+    all := []string{ "no-agent-forwarding", "no-port-forwarding", "no-pty", "no-X11-forwarding" }
+
+    for _, test := range []struct {
+        options     []string
+        restricted  []string
+    }{
+        { nil, nil },
+        { []string{ "no-pty" }, []string{ "no-pty" } },
+        { []string{ "no-X11-forwarding", "no-agent-forwarding" }, []string{ "no-X11-forwarding", "no-agent-forwarding" } },
+        { []string{ "no-port-forwarding" }, []string{ "no-port-forwarding" } },
+        { []string{ "restrict" }, all },
+        { []string{ "restrict", "pty" }, []string{ "no-agent-forwarding", "no-port-forwarding", "no-X11-forwarding" } },
+        { []string{ "restrict", "agent-forwarding", "X11-forwarding" }, []string{ "no-port-forwarding", "no-pty" } },
+        { []string{ "restrict", "pty", "no-pty" }, all },
+    } {
+        perm, err := keyOptionPermissions(conn, test.options)
+        if err != nil {
+            t.Fatal(err)
+        }
+        for _, ext := range all {
+            _, set := perm.Extensions[ext]
+            if set != containsString(test.restricted, ext) {
+                t.Errorf("Options %v: expected %s set to be %v", test.options, ext, ! set)
+            }
+        }
+    }
+}
+
+func TestSessionRequestDenied(t *testing.T) {
+    perm, err := keyOptionPermissions(testConnMetadata{ user: "alice" }, []string{ "restrict", "agent-forwarding" })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for reqType, denied := range map[string]bool{
+        "pty-req":                      true,
+        "x11-req":                      true,
+        "auth-agent-req@openssh.com":   false,
+        "shell":                        false,
+        "window-change":                false,
+    } {
+        if sessionRequestDenied(perm, reqType) != denied {
+            t.Errorf("%s: expected denied %v", reqType, denied)
+        }
+    }
+
+    if sessionRequestDenied(&ssh.Permissions{}, "pty-req") || sessionRequestDenied(nil, "pty-req") {
+        t.Errorf("Expected an unrestricted pty-req to be allowed")
+    }
+}
+
+func TestMatchAuthorizedKeysOptions(t *testing.T) {
+    key := newTestSigner(t).PublicKey()
+    entry := `restrict,pty,command="web1" ` + string(ssh.MarshalAuthorizedKey(key))
+
+    perm, err := matchAuthorizedKeys(testConnMetadata{ user: "alice" }, key, []byte(entry), "test")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if perm.CriticalOptions["force-command"] != "web1" {
+        t.Errorf("Expected command=\"web1\" to force the server")
+    }
+    if sessionRequestDenied(perm, "pty-req") || ! sessionRequestDenied(perm, "x11-req") {
+        t.Errorf("Expected pty to be re-enabled and X11 forwarding restricted")
+    }
+}
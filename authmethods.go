@@ -0,0 +1,186 @@
+package main
+
+import (
+    "fmt"
+    "strings"
+    "golang.org/x/crypto/ssh"
+)
+
+func parseAuthMethods(alternative string) []string {
+    var methods []string
+    for _, method := range strings.Split(alternative, ",") {
+        if method = strings.TrimSpace(method); len(method) > 0 {
+            methods = append(methods, method)
+        }
+    }
+    return methods
+}
+
+// Returns the auth_methods policies that apply to a connection, the user's
+// own and those of every ACL granted to it. ACLs outside of their time window
+// or allowed_sources are included, as a window may open later in the session.
+// A policy is a list of alternatives, each a comma separated list of methods,
+// any one of which satisfies it.
+func authMethodsPolicies(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions) [][]string {
+    var policies [][]string
+
+    if user, ok := c.Users[conn.User()]; ok && len(user.AuthMethods) > 0 {
+        policies = append(policies, user.AuthMethods)
+    }
+
+    for _, name := range grantedACLs(c, conn.User(), perm) {
+        if acl, ok := c.ACLs[name]; ok && len(acl.AuthMethods) > 0 {
+            policies = append(policies, acl.AuthMethods)
+        }
+    }
+
+    return policies
+}
+
+// Returns how many of the alternative's methods have been completed in order.
+func matchedAuthMethods(completed []string, methods []string) int {
+    n := 0
+    for _, method := range completed {
+        if n < len(methods) && methods[n] == method {
+            n++
+        }
+    }
+    return n
+}
+
+// Returns the methods that may be used next to progress towards satisfying
+// every policy, which is none once they all are.
+func nextAuthMethods(completed []string, policies [][]string) []string {
+    var next []string
+
+    for _, policy := range policies {
+        var candidates []string
+        satisfied := false
+        for _, alternative := range policy {
+            methods := parseAuthMethods(alternative)
+            n := matchedAuthMethods(completed, methods)
+            if n == len(methods) {
+                satisfied = true
+                break
+            }
+            candidates = appendUnique(candidates, methods[n])
+        }
+
+        if ! satisfied {
+            for _, method := range candidates {
+                next = appendUnique(next, method)
+            }
+        }
+    }
+
+    return next
+}
+
+// Combines the permissions from an earlier step with those of the latest,
+// keeping the restrictions and ACLs of both.
+func mergePermissions(prev *ssh.Permissions, perm *ssh.Permissions) *ssh.Permissions {
+    if prev == nil {
+        return perm
+    }
+
+    merged := &ssh.Permissions{
+        CriticalOptions:    map[string]string{},
+        Extensions:         map[string]string{},
+    }
+    for _, p := range []*ssh.Permissions{ prev, perm } {
+        for k, v := range p.CriticalOptions {
+            if _, ok := merged.CriticalOptions[k]; ! ok {
+                merged.CriticalOptions[k] = v
+            }
+        }
+        mergeExtensions(merged.Extensions, p.Extensions)
+    }
+
+    return merged
+}
+
+// Records the method just completed and, if the user or ACL auth_methods
+// require further methods, asks for them through partial success.
+func withAuthMethods(c *SSHConfig, conn ssh.ConnMetadata, method string, perm *ssh.Permissions, err error) (*ssh.Permissions, error) {
+    if err != nil {
+        return perm, err
+    }
+
+    var completed []string
+    if len(perm.Extensions["authMethods"]) > 0 {
+        completed = strings.Split(perm.Extensions["authMethods"], ",")
+    }
+    completed = append(completed, method)
+    perm.Extensions["authMethods"] = strings.Join(completed, ",")
+
+    next := nextAuthMethods(completed, authMethodsPolicies(c, conn, perm))
+    if len(next) == 0 {
+        return perm, nil
+    }
+
+    callbacks := ssh.ServerAuthCallbacks{}
+    for _, method := range next {
+        switch method {
+            case "password":
+                callbacks.PasswordCallback = passwordStep(c, perm)
+            case "publickey":
+                callbacks.PublicKeyCallback = publicKeyStep(c, perm)
+            case "keyboard-interactive":
+                callbacks.KeyboardInteractiveCallback = keyboardInteractiveStep(c, perm)
+            default:
+                WriteAuthLog("Unknown auth method %s in auth_methods for user %s", method, conn.User())
+        }
+    }
+
+    if callbacks.PasswordCallback == nil && callbacks.PublicKeyCallback == nil && callbacks.KeyboardInteractiveCallback == nil {
+        return nil, fmt.Errorf("No Valid Auth Methods")
+    }
+
+    return nil, &ssh.PartialSuccessError{ Next: callbacks }
+}
+
+// Password auth, following on from the permissions of any earlier steps.
+func passwordStep(c *SSHConfig, prev *ssh.Permissions) func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+    return func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+        conn = bastionConn(c, conn)
+        if err := authLimiter.Check(conn); err != nil {
+            return nil, err
+        }
+        perm, err := AuthUserPass(c, conn, password)
+        return finishAuth(c, conn, "password", prev, perm, err)
+    }
+}
+
+// Public key auth, following on from the permissions of any earlier steps.
+func publicKeyStep(c *SSHConfig, prev *ssh.Permissions) func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+    return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+        conn = bastionConn(c, conn)
+        if err := authLimiter.Check(conn); err != nil {
+            return nil, err
+        }
+        perm, err := AuthPublicKey(c, conn, key)
+        return finishAuth(c, conn, "publickey", prev, perm, err)
+    }
+}
+
+// Asks for the password via keyboard-interactive, for clients that only
+// prompt that way (or policies naming keyboard-interactive explicitly).
+func keyboardInteractiveStep(c *SSHConfig, prev *ssh.Permissions) func(ssh.ConnMetadata, ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+    return func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+        conn = bastionConn(c, conn)
+        if err := authLimiter.Check(conn); err != nil {
+            return nil, err
+        }
+
+        answers, err := client("", "", []string{ "Password: " }, []bool{ false })
+        if err != nil {
+            return nil, err
+        }
+        if len(answers) != 1 {
+            return nil, fmt.Errorf("Invalid Keyboard-Interactive Response")
+        }
+
+        perm, err := AuthUserPass(c, conn, []byte(answers[0]))
+        return finishAuth(c, conn, "keyboard-interactive", prev, perm, err)
+    }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+    "testing"
+    "reflect"
+    "golang.org/x/crypto/ssh"
+)
+
+func TestNextAuthMethods(t *testing.T) {
+    policies := [][]string{
+        { "publickey,password", "publickey,keyboard-interactive" },
+        { "password" },
+    }
+
+    for _, test := range []struct {
+        completed   []string
+        next        []string
+    }{
+        { nil, []string{ "publickey", "password" } },
+        { []string{ "password" }, []string{ "publickey" } },
+        { []string{ "publickey" }, []string{ "password", "keyboard-interactive" } },
+        { []string{ "publickey", "keyboard-interactive" }, []string{ "password" } },
+        { []string{ "publickey", "password" }, nil },
+        // Methods only count in the order the alternative lists them.
+        { []string{ "password", "publickey" }, []string{ "password", "keyboard-interactive" } },
+    } {
+        if next := nextAuthMethods(test.completed, policies); ! reflect.DeepEqual(next, test.next) {
+            t.Errorf("Completed %v: expected %v, got %v", test.completed, test.next, next)
+        }
+    }
+}
+
+// An ACL that isn't usable at login may open later in the session, so its
+// auth_methods still apply.
+func TestAuthMethodsPoliciesClosedACLs(t *testing.T) {
+    c := parseTestConfig(t, `
+acls:
+    closed:
+        allow_list: [ "web1" ]
+        auth_methods: [ "publickey,password" ]
+        valid_from: "2999-01-01"
+    elsewhere:
+        allow_list: [ "web2" ]
+        auth_methods: [ "publickey,keyboard-interactive" ]
+        allowed_sources: [ "198.51.100.0/24" ]
+    open:
+        allow_list: [ "web3" ]
+users:
+    alice:
+        acl: "closed"
+        auth_methods: [ "publickey" ]
+servers:
+    web1:
+        connect_path: "web1:22"
+    web2:
+        connect_path: "web2:22"
+    web3:
+        connect_path: "web3:22"
+`)
+    conn := testConnMetadata{ user: "alice" }
+    perm := &ssh.Permissions{ Extensions: map[string]string{ "acls": "elsewhere,open" } }
+
+    if acls := userACLs(c, conn, perm); ! reflect.DeepEqual(acls, []string{ "open" }) {
+        t.Fatalf("Expected only the open ACL to be usable, got %v", acls)
+    }
+
+    expected := [][]string{ { "publickey" }, { "publickey,password" }, { "publickey,keyboard-interactive" } }
+    if policies := authMethodsPolicies(c, conn, perm); ! reflect.DeepEqual(policies, expected) {
+        t.Errorf("Expected %v, got %v", expected, policies)
+    }
+
+    if next := nextAuthMethods([]string{ "publickey" }, authMethodsPolicies(c, conn, perm)); ! reflect.DeepEqual(next, []string{ "password", "keyboard-interactive" }) {
+        t.Errorf("Expected the closed ACLs to require further methods, got %v", next)
+    }
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "golang.org/x/crypto/ssh"
+)
+
+// Returns whether a key (or certificate) is listed in the revoked keys file.
+// If the file is configured but can't be loaded, all keys are treated as revoked.
+func isKeyRevoked(c *SSHConfig, key ssh.PublicKey) bool {
+    if len(c.Global.RevokedKeysFile) == 0 {
+        return false
+    }
+
+    krl, err := LoadRevocationList(c.Global.RevokedKeysFile)
+    if err != nil {
+        log.Printf("%s", err)
+        return true
+    }
+
+    if cert, ok := key.(*ssh.Certificate); ok {
+        return krl.IsCertRevoked(cert)
+    }
+    return krl.IsKeyRevoked(key)
+}
+
+func isTrustedUserCA(c *SSHConfig, auth ssh.PublicKey) bool {
+    for _, caFile := range c.Global.TrustedUserCAKeys {
+        caData, err := ioutil.ReadFile(caFile)
+        if err != nil {
+            log.Printf("Unable to read trusted user CA file (%s): %s", caFile, err)
+            continue
+        }
+
+        for len(bytes.TrimSpace(caData)) > 0 {
+            var caKey ssh.PublicKey
+            caKey, _, _, caData, err = ssh.ParseAuthorizedKey(caData)
+            if err != nil {
+                log.Printf("Error while processing trusted user CA file (%s): %s", caFile, err)
+                break
+            }
+
+            if bytes.Equal(auth.Marshal(), caKey.Marshal()) {
+                return true
+            }
+        }
+    }
+
+    return false
+}
+
+// Parses an address or CIDR range from a source address list, an address
+// alone being a range of just that address.
+func parseSourceAddress(sourceAddr string) (*net.IPNet, error) {
+    if ip := net.ParseIP(sourceAddr); ip != nil {
+        if ip4 := ip.To4(); ip4 != nil {
+            return &net.IPNet{ IP: ip4, Mask: net.CIDRMask(32, 32) }, nil
+        }
+        return &net.IPNet{ IP: ip, Mask: net.CIDRMask(128, 128) }, nil
+    }
+
+    _, ipNet, err := net.ParseCIDR(sourceAddr)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid source address (%s), expected an address or CIDR range", sourceAddr)
+    }
+    return ipNet, nil
+}
+
+// Checks the remote address against a comma separated list of addresses and
+// CIDR ranges, as used by the source-address certificate option.
+func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
+    tcpAddr, ok := addr.(*net.TCPAddr)
+    if ! ok {
+        return fmt.Errorf("Unable to check source address of %s", addr)
+    }
+
+    for _, sourceAddr := range strings.Split(sourceAddrs, ",") {
+        ipNet, err := parseSourceAddress(strings.TrimSpace(sourceAddr))
+        if err != nil {
+            return err
+        }
+        if ipNet.Contains(tcpAddr.IP) {
+            return nil
+        }
+    }
+
+    return fmt.Errorf("Source address %s not permitted", tcpAddr.IP)
+}
+
+// The OpenSSH permit-* certificate extensions and the restriction applied
+// when one is missing. No other extensions are copied, as the permissions
+// also hold the bastion's own auth state (e.g. "totp" or "acls").
+var certPermitExtensions = map[string]string{
+    "permit-agent-forwarding":  "no-agent-forwarding",
+    "permit-port-forwarding":   "no-port-forwarding",
+    "permit-pty":               "no-pty",
+    "permit-X11-forwarding":    "no-X11-forwarding",
+}
+
+// Authenticates an OpenSSH user certificate signed by one of the trusted
+// user CAs, with a principal matching the bastion username.
+func AuthCertificate(c *SSHConfig, conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, error) {
+    if len(c.Global.TrustedUserCAKeys) == 0 {
+        return nil, fmt.Errorf("No Trusted User CAs Configured")
+    }
+
+    checker := &ssh.CertChecker{
+        IsUserAuthority:            func(auth ssh.PublicKey) bool {
+            return isTrustedUserCA(c, auth)
+        },
+        IsRevoked:                  func(cert *ssh.Certificate) bool {
+            return isKeyRevoked(c, cert)
+        },
+        SupportedCriticalOptions:   []string{ "source-address", "force-command" },
+    }
+
+    // Checks the CA, principals, validity window, critical options and revocation.
+    certPerm, err := checker.Authenticate(conn, cert)
+    if err != nil {
+        log.Printf("Certificate (ID: %s, Serial: %d) rejected for user (%s): %s", cert.KeyId, cert.Serial, conn.User(), err)
+        return nil, fmt.Errorf("Certificate Rejected: %s", err)
+    }
+
+    if sourceAddrs, ok := certPerm.CriticalOptions["source-address"]; ok {
+        if err := checkSourceAddress(conn.RemoteAddr(), sourceAddrs); err != nil {
+            log.Printf("Certificate (ID: %s, Serial: %d) rejected for user (%s): %s", cert.KeyId, cert.Serial, conn.User(), err)
+            return nil, fmt.Errorf("Certificate Rejected: %s", err)
+        }
+    }
+
+    perm := &ssh.Permissions{
+        CriticalOptions:    map[string]string{},
+        Extensions:         map[string]string{},
+    }
+    for k, v := range certPerm.CriticalOptions {
+        perm.CriticalOptions[k] = v
+    }
+    perm.Extensions["authType"] = "cert"
+
+    // As with OpenSSH, forwarding and ptys must be permitted by the certificate.
+    for permit, restriction := range certPermitExtensions {
+        if _, ok := certPerm.Extensions[permit]; ! ok {
+            perm.Extensions[restriction] = ""
+        }
+    }
+
+    log.Printf("Accepted certificate (ID: %s, Serial: %d) for user (%s)", cert.KeyId, cert.Serial, conn.User())
+
+    return perm, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+    "time"
+    "testing"
+    "io/ioutil"
+    "crypto/rand"
+    "crypto/ed25519"
+    "path/filepath"
+    "golang.org/x/crypto/ssh"
+)
+
+func newTestSigner(t *testing.T) ssh.Signer {
+    _, key, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    signer, err := ssh.NewSignerFromKey(key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return signer
+}
+
+// Returns a config trusting a new user CA, and the CA.
+func newTestUserCA(t *testing.T) (*SSHConfig, ssh.Signer) {
+    ca := newTestSigner(t)
+    caFile := filepath.Join(t.TempDir(), "user_ca.pub")
+    if err := ioutil.WriteFile(caFile, ssh.MarshalAuthorizedKey(ca.PublicKey()), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    c := &SSHConfig{}
+    c.Global.TrustedUserCAKeys = []string{ caFile }
+    return c, ca
+}
+
+func newTestCert(t *testing.T, ca ssh.Signer, serial uint64, keyID string, extensions map[string]string) *ssh.Certificate {
+    cert := &ssh.Certificate{
+        Key:                newTestSigner(t).PublicKey(),
+        Serial:             serial,
+        CertType:           ssh.UserCert,
+        KeyId:              keyID,
+        ValidPrincipals:    []string{ "alice" },
+        ValidAfter:         uint64(time.Now().Add(-time.Hour).Unix()),
+        ValidBefore:        uint64(time.Now().Add(time.Hour).Unix()),
+        Permissions:        ssh.Permissions{ Extensions: extensions },
+    }
+    if err := cert.SignCert(rand.Reader, ca); err != nil {
+        t.Fatal(err)
+    }
+    return cert
+}
+
+func TestAuthCertificatePermits(t *testing.T) {
+    c, ca := newTestUserCA(t)
+
+    perm, err := AuthCertificate(c, testConnMetadata{ user: "alice" }, newTestCert(t, ca, 1, "alice", map[string]string{
+        "permit-pty":               "",
+        "permit-port-forwarding":   "",
+    }))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, restriction := range []string{ "no-agent-forwarding", "no-X11-forwarding" } {
+        if _, ok := perm.Extensions[restriction]; ! ok {
+            t.Errorf("Expected %s without its permit extension", restriction)
+        }
+    }
+    for _, restriction := range []string{ "no-pty", "no-port-forwarding" } {
+        if _, ok := perm.Extensions[restriction]; ok {
+            t.Errorf("Expected no %s with its permit extension", restriction)
+        }
+    }
+}
+
+// Extensions a CA may sign that share names with the bastion's auth state.
+func TestAuthCertificateIgnoresInternalExtensions(t *testing.T) {
+    c, ca := newTestUserCA(t)
+
+    internal := map[string]string{
+        "totp":                 "true",
+        "acls":                 "admins",
+        "allowed_servers":      "prod-db",
+        "authMethods":          "password",
+        "login_user":           "root",
+        "password":             "secret",
+    }
+    perm, err := AuthCertificate(c, testConnMetadata{ user: "alice" }, newTestCert(t, ca, 1, "alice", internal))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for k := range internal {
+        if v, ok := perm.Extensions[k]; ok {
+            t.Errorf("Expected the certificate's %s extension to be ignored, got %q", k, v)
+        }
+    }
+    if perm.Extensions["authType"] != "cert" {
+        t.Errorf("Expected authType cert, got %q", perm.Extensions["authType"])
+    }
+}
+
+func TestAuthCertificateUntrustedCA(t *testing.T) {
+    c, _ := newTestUserCA(t)
+
+    if _, err := AuthCertificate(c, testConnMetadata{ user: "alice" }, newTestCert(t, newTestSigner(t), 1, "alice", nil)); err == nil {
+        t.Errorf("Expected a certificate from an untrusted CA to be rejected")
+    }
+}
@@ -2,55 +2,255 @@ package main
 
 import (
     "fmt"
+    "sort"
+    "strings"
     "io/ioutil"
+    "path/filepath"
     "gopkg.in/yaml.v2"
 )
 
 type SSHConfig struct {
+    Include                 []string                        `yaml:"include"`
     Global                  SSHConfigGlobal                 `yaml:"global"`
     Servers                 map[string]SSHConfigServer      `yaml:"servers"`
     ACLs                    map[string]SSHConfigACL         `yaml:"acls"`
     Users                   map[string]SSHConfigUser        `yaml:"users"`
+    GroupACLs               map[string]string               `yaml:"group_acls"`
 }
 
 type SSHConfigGlobal struct {
     MOTDPath                string                          `yaml:"motd_path"`
     LogPath                 string                          `yaml:"log_path"`
     HostKeyPaths            []string                        `yaml:"host_keys"`
-    AuthType                string                          `yaml:"auth_type"`
+    AuthType                AuthBackendList                 `yaml:"auth_type"`
+    AuthMode                string                          `yaml:"auth_mode"`
     LDAP_Server             string                          `yaml:"ldap_server"`
     LDAP_Domain             string                          `yaml:"ldap_domain"`
+    LDAP_TLS                string                          `yaml:"ldap_tls"`
+    LDAP_CAFile             string                          `yaml:"ldap_ca_file"`
+    LDAP_ServerName         string                          `yaml:"ldap_server_name"`
+    LDAP_ClientCert         string                          `yaml:"ldap_client_cert"`
+    LDAP_ClientKey          string                          `yaml:"ldap_client_key"`
+    LDAP_BaseDN             string                          `yaml:"ldap_base_dn"`
+    LDAP_UserFilter         string                          `yaml:"ldap_user_filter"`
+    LDAP_BindDN             string                          `yaml:"ldap_bind_dn"`
+    LDAP_BindPassword       string                          `yaml:"ldap_bind_password"`
+    LocalPasswordFile       string                          `yaml:"local_password_file"`
+    RADIUS_Servers          []string                        `yaml:"radius_servers"`
+    RADIUS_Secret           string                          `yaml:"radius_secret"`
+    RADIUS_Timeout          string                          `yaml:"radius_timeout"`
+    RADIUS_Retries          int                             `yaml:"radius_retries"`
+    RADIUS_NASIdentifier    string                          `yaml:"radius_nas_identifier"`
+    RADIUS_RequireMessageAuthenticator  bool                `yaml:"radius_require_message_authenticator"`
+    WebhookURL              string                          `yaml:"webhook_url"`
+    WebhookSecret           string                          `yaml:"webhook_secret"`
+    WebhookTimeout          string                          `yaml:"webhook_timeout"`
+    WebhookPublicKey        bool                            `yaml:"webhook_public_key"`
+    TrustedUserCAKeys       []string                        `yaml:"trusted_user_ca_keys"`
+    RevokedKeysFile         string                          `yaml:"revoked_keys_file"`
+    AuthorizedKeysCommand           string                  `yaml:"authorized_keys_command"`
+    AuthorizedKeysCommandUser       string                  `yaml:"authorized_keys_command_user"`
+    AuthorizedKeysCommandTimeout    string                  `yaml:"authorized_keys_command_timeout"`
+    AuthorizedKeysCommandCache      string                  `yaml:"authorized_keys_command_cache"`
+    TOTPSecretsFile         string                          `yaml:"totp_secrets_file"`
+    RequireTOTP             bool                            `yaml:"require_totp"`
     PassPassword            bool                            `yaml:"pass_password"`
+    UpstreamCAKey           string                          `yaml:"upstream_ca_key"`
+    UpstreamCertValidity    string                          `yaml:"upstream_cert_validity"`
     ListenPath              string                          `yaml:"listen_path"`
+    MaxAuthFailuresPerIP    int                             `yaml:"max_auth_failures_per_ip"`
+    MaxAuthFailuresPerUser  int                             `yaml:"max_auth_failures_per_user"`
+    AuthFailureWindow       string                          `yaml:"auth_failure_window"`
+    AuthBanTime             string                          `yaml:"auth_ban_time"`
+    AuthMaxBanTime          string                          `yaml:"auth_max_ban_time"`
+    AuthBanStateFile        string                          `yaml:"auth_ban_state_file"`
+    StrictInterpolation     bool                            `yaml:"strict_interpolation"`
+    GroupACLsMatchCN        bool                            `yaml:"group_acls_match_cn"`
 }
 
 type SSHConfigServer struct {
     HostPubKeyFiles         []string                        `yaml:"host_pubkeys"`
     ConnectPath             string                          `yaml:"connect_path"`
     LoginUser               string                          `yaml:"login_user"`
+    UserMap                 map[string]string               `yaml:"user_map"`
+    Tags                    map[string]string               `yaml:"tags"`
 }
 
 type SSHConfigACL struct {
     AllowedServers          []string                        `yaml:"allow_list"`
+    DeniedServers           []string                        `yaml:"deny_list"`
+    AllowedSources          []string                        `yaml:"allowed_sources"`
+    AuthMethods             []string                        `yaml:"auth_methods"`
+    LoginUsers              []string                        `yaml:"login_users"`
+    SSHConfigTimeWindow                                     `yaml:",inline"`
 }
 
 type SSHConfigUser struct {
     ACL                     string                          `yaml:"acl"`
     AuthorizedKeysFile      string                          `yaml:"authorized_keys_file"`
+    TOTPSecret              string                          `yaml:"totp_secret"`
+    RequireTOTP             bool                            `yaml:"require_totp"`
+    AllowedSources          []string                        `yaml:"allowed_sources"`
+    AuthMethods             []string                        `yaml:"auth_methods"`
+    SSHConfigTimeWindow                                     `yaml:",inline"`
 }
 
-func fetchConfig(filename string) (*SSHConfig, error) {
-    configData, err := ioutil.ReadFile(filename)
+// Limits when an ACL or user may be used, between valid_from and valid_until
+// and within any of the schedule entries (e.g. "Mon-Fri 09:00-17:00").
+type SSHConfigTimeWindow struct {
+    ValidFrom               string                          `yaml:"valid_from"`
+    ValidUntil              string                          `yaml:"valid_until"`
+    Schedule                []string                        `yaml:"schedule"`
+    TimeZone                string                          `yaml:"time_zone"`
+    EndSessions             bool                            `yaml:"end_sessions"`
+}
+
+type SSHConfigAuthBackend struct {
+    Type                    string                          `yaml:"type"`
+    Required                bool                            `yaml:"required"`
+    // Global settings of the backend's type that only apply to this backend,
+    // e.g. the ldap_server of a second directory.
+    Settings                map[string]interface{}          `yaml:",inline"`
+}
+
+// Backends for password auth, either a single auth type name or a list of
+// names and/or backends with settings.
+type AuthBackendList []SSHConfigAuthBackend
+
+func (b *SSHConfigAuthBackend) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var name string
+    if err := unmarshal(&name); err == nil {
+        b.Type = name
+        return nil
+    }
+
+    type plain SSHConfigAuthBackend
+    return unmarshal((*plain)(b))
+}
+
+func (l *AuthBackendList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+    var name string
+    if err := unmarshal(&name); err == nil {
+        *l = AuthBackendList{ SSHConfigAuthBackend{ Type: name } }
+        return nil
+    }
+
+    var backends []SSHConfigAuthBackend
+    if err := unmarshal(&backends); err != nil {
+        return err
+    }
+    *l = AuthBackendList(backends)
+    return nil
+}
+
+// A config file and what it defines, kept to report problems by file and line.
+type configSource struct {
+    Filename                string
+    Data                    []byte
+    Config                  *SSHConfig
+}
+
+// Expands the include globs, relative to the directory of the main config
+// file, into a sorted list of files.
+func includeFiles(filename string, patterns []string) ([]string, error) {
+    var files []string
+    for _, pattern := range patterns {
+        if ! filepath.IsAbs(pattern) {
+            pattern = filepath.Join(filepath.Dir(filename), pattern)
+        }
+
+        matches, err := filepath.Glob(pattern)
+        if err != nil {
+            return nil, fmt.Errorf("Invalid include pattern (%s): %s", pattern, err)
+        }
+        sort.Strings(matches)
+
+        for _, match := range matches {
+            if match != filepath.Clean(filename) {
+                files = appendUnique(files, match)
+            }
+        }
+    }
+    return files, nil
+}
+
+func readConfigSource(filename string) (configSource, error) {
+    data, err := ioutil.ReadFile(filename)
     if err != nil {
-        return nil, fmt.Errorf("Failed to open config file: %s", err)
+        return configSource{}, fmt.Errorf("Failed to open config file: %s", err)
     }
 
     config := &SSHConfig{}
+    if err := yaml.Unmarshal(data, config); err != nil {
+        return configSource{}, fmt.Errorf("Unable to parse YAML config file (%s): %s", filename, err)
+    }
+
+    return configSource{ Filename: filename, Data: data, Config: config }, nil
+}
 
-    err = yaml.Unmarshal(configData, config)
+// Reads the config file and the files it includes, merging the servers,
+// ACLs, users and group ACLs they define. Where an entry is defined more
+// than once the first definition is used, validateConfig reports the rest.
+func readConfigFiles(filename string) (*SSHConfig, []configSource, error) {
+    main, err := readConfigSource(filename)
     if err != nil {
-        return nil, fmt.Errorf("Unable to parse YAML config file: %s", err)
+        return nil, nil, err
+    }
+    sources := []configSource{ main }
+
+    files, err := includeFiles(filename, main.Config.Include)
+    if err != nil {
+        return nil, nil, err
+    }
+    for _, file := range files {
+        source, err := readConfigSource(file)
+        if err != nil {
+            return nil, nil, err
+        }
+        sources = append(sources, source)
     }
 
+    config := &SSHConfig{
+        Include:    main.Config.Include,
+        Global:     main.Config.Global,
+        Servers:    map[string]SSHConfigServer{},
+        ACLs:       map[string]SSHConfigACL{},
+        Users:      map[string]SSHConfigUser{},
+        GroupACLs:  map[string]string{},
+    }
+    for _, source := range sources {
+        for name, server := range source.Config.Servers {
+            if _, ok := config.Servers[name]; ! ok {
+                config.Servers[name] = server
+            }
+        }
+        for name, acl := range source.Config.ACLs {
+            if _, ok := config.ACLs[name]; ! ok {
+                config.ACLs[name] = acl
+            }
+        }
+        for name, user := range source.Config.Users {
+            if _, ok := config.Users[name]; ! ok {
+                config.Users[name] = user
+            }
+        }
+        for group, acl := range source.Config.GroupACLs {
+            if _, ok := config.GroupACLs[group]; ! ok {
+                config.GroupACLs[group] = acl
+            }
+        }
+    }
+
+    return config, sources, nil
+}
+
+func fetchConfig(filename string) (*SSHConfig, error) {
+    config, _, err := readConfigFiles(filename)
+    if err != nil {
+        return nil, err
+    }
+    if errs := interpolateConfig(config); len(errs) > 0 {
+        return nil, fmt.Errorf("Config value at %s: %s", strings.Join(errs[0].Path, "."), errs[0].Err)
+    }
     return config, nil
 }
@@ -0,0 +1,463 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "path"
+    "sort"
+    "time"
+    "strconv"
+    "strings"
+    "io/ioutil"
+    "golang.org/x/crypto/ssh"
+    "gopkg.in/yaml.v2"
+    yamlv3 "gopkg.in/yaml.v3"
+)
+
+// A problem found in the config, with the file and line it is on if known.
+type configProblem struct {
+    File        string
+    Line        int
+    Message     string
+}
+
+func (p configProblem) String() string {
+    if p.Line > 0 {
+        return fmt.Sprintf("%s: line %d: %s", p.File, p.Line, p.Message)
+    }
+    return fmt.Sprintf("%s: %s", p.File, p.Message)
+}
+
+// Returns the value of a key in a mapping, or the item of a sequence that is
+// the key or a mapping with the key, with the line the key or item is on.
+func configChild(node *yamlv3.Node, key string) (*yamlv3.Node, int) {
+    if node.Kind == yamlv3.AliasNode {
+        node = node.Alias
+    }
+
+    switch node.Kind {
+        case yamlv3.MappingNode:
+            for i := 0; i + 1 < len(node.Content); i += 2 {
+                if node.Content[i].Value == key {
+                    return node.Content[i+1], node.Content[i].Line
+                }
+            }
+        case yamlv3.SequenceNode:
+            for _, item := range node.Content {
+                if item.Kind == yamlv3.ScalarNode && item.Value == key {
+                    return item, item.Line
+                }
+            }
+            for _, item := range node.Content {
+                if next, line := configChild(item, key); next != nil {
+                    return next, line
+                }
+            }
+    }
+    return nil, 0
+}
+
+// Finds the line of a key path (the last element may also be a list value)
+// from the positions yaml.v3 keeps, as yaml.v2 doesn't keep them for decoded
+// values. Also returns how much of the path was found, where the whole of it
+// wasn't the line is that of the nearest parent found.
+func configPosition(data []byte, path []string) (int, int) {
+    var doc yamlv3.Node
+    if err := yamlv3.Unmarshal(data, &doc); err != nil || len(doc.Content) == 0 {
+        return 0, 0
+    }
+
+    node := doc.Content[0]
+    line := 0
+    for depth, key := range path {
+        next, keyLine := configChild(node, key)
+        if next == nil {
+            return line, depth
+        }
+        node, line = next, keyLine
+    }
+    return line, len(path)
+}
+
+// Returns the line of a key path, or 0 if it can't be found.
+func configLine(data []byte, path ...string) int {
+    if line, depth := configPosition(data, path); depth == len(path) {
+        return line
+    }
+    return 0
+}
+
+func checkConnectPath(connectPath string) error {
+    host, port, err := net.SplitHostPort(connectPath)
+    if err != nil {
+        return err
+    }
+    if len(host) == 0 {
+        return fmt.Errorf("missing host")
+    }
+    if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+        return fmt.Errorf("invalid port (%s)", port)
+    }
+    return nil
+}
+
+// Checks an allow_list / deny_list rule. Plain server names must exist, while
+// wildcard and tag rules may match no servers (yet).
+func checkServerRule(c *SSHConfig, rule string) error {
+    if strings.HasPrefix(rule, "tag:") {
+        parts := strings.SplitN(strings.TrimPrefix(rule, "tag:"), "=", 2)
+        if len(parts[0]) == 0 {
+            return fmt.Errorf("missing tag name in (%s)", rule)
+        }
+        if len(parts) == 2 {
+            if _, err := path.Match(parts[1], ""); err != nil {
+                return fmt.Errorf("invalid tag pattern (%s): %s", rule, err)
+            }
+        }
+        return nil
+    }
+
+    if strings.ContainsAny(rule, "*?[") {
+        if _, err := path.Match(rule, ""); err != nil {
+            return fmt.Errorf("invalid server pattern (%s): %s", rule, err)
+        }
+        return nil
+    }
+
+    if _, ok := c.Servers[rule]; ! ok {
+        return fmt.Errorf("unknown server (%s)", rule)
+    }
+    return nil
+}
+
+func checkAuthMethods(alternatives []string) error {
+    for _, alternative := range alternatives {
+        methods := parseAuthMethods(alternative)
+        if len(methods) == 0 {
+            return fmt.Errorf("empty auth method list")
+        }
+        for _, method := range methods {
+            switch method {
+                case "password", "publickey", "keyboard-interactive":
+                default:
+                    return fmt.Errorf("unknown auth method (%s)", method)
+            }
+        }
+    }
+    return nil
+}
+
+// Checks the config for problems that would otherwise only show up at
+// login, such as unknown keys, references to ACLs or servers that don't
+// exist, entries defined in more than one file and unreadable key files.
+func validateConfig(c *SSHConfig, sources []configSource) []configProblem {
+    var problems []configProblem
+
+    add := func(path []string, format string, v ...interface{}) {
+        problems = append(problems, locateProblem(sources, path, fmt.Sprintf(format, v...)))
+    }
+
+    // Parses allowed_sources and time windows as they are at login.
+    checkSources := func(path []string, kind string, name string, sources []string) {
+        for _, entry := range sources {
+            for _, sourceAddr := range strings.Split(entry, ",") {
+                if _, err := parseSourceAddress(strings.TrimSpace(sourceAddr)); err != nil {
+                    add(append(path, "allowed_sources", entry), "%s (%s) has invalid allowed_sources: %s", kind, name, err)
+                }
+            }
+        }
+    }
+    checkTimeWindow := func(path []string, kind string, name string, w SSHConfigTimeWindow) {
+        loc, err := w.location()
+        if err != nil {
+            add(append(path, "time_zone"), "%s (%s) has an invalid time window: %s", kind, name, err)
+            loc = time.UTC
+        }
+        for key, value := range map[string]string{ "valid_from": w.ValidFrom, "valid_until": w.ValidUntil } {
+            if _, err := parseWindowTime(value, loc); len(value) > 0 && err != nil {
+                add(append(path, key), "%s (%s) has an invalid %s: %s", kind, name, key, err)
+            }
+        }
+        for _, entry := range w.Schedule {
+            if _, err := parseScheduleEntry(entry); err != nil {
+                add(append(path, "schedule", entry), "%s (%s) has an invalid schedule: %s", kind, name, err)
+            }
+        }
+    }
+
+    seen := map[string]string{}
+    duplicate := func(source configSource, section string, name string) {
+        key := section + " " + name
+        if first, ok := seen[key]; ok {
+            problems = append(problems, configProblem{
+                File:       source.Filename,
+                Line:       configLine(source.Data, section, name),
+                Message:    fmt.Sprintf("duplicate %s entry (%s), already defined in %s", section, name, first),
+            })
+        } else {
+            seen[key] = source.Filename
+        }
+    }
+
+    for i, source := range sources {
+        // Unknown keys are most likely typos, which yaml.Unmarshal silently ignores.
+        if err := yaml.UnmarshalStrict(source.Data, &SSHConfig{}); err != nil {
+            if typeErr, ok := err.(*yaml.TypeError); ok {
+                for _, e := range typeErr.Errors {
+                    problem := configProblem{ File: source.Filename, Message: e }
+                    if n, _ := fmt.Sscanf(e, "line %d: ", &problem.Line); n == 1 {
+                        problem.Message = strings.TrimPrefix(e, fmt.Sprintf("line %d: ", problem.Line))
+                    }
+                    problems = append(problems, problem)
+                }
+            } else {
+                problems = append(problems, configProblem{ File: source.Filename, Message: err.Error() })
+            }
+        }
+
+        // Included files may only add servers, ACLs, users and group ACLs.
+        if i > 0 {
+            for _, section := range []string{ "global", "include" } {
+                if line := configLine(source.Data, section); line > 0 {
+                    problems = append(problems, configProblem{ File: source.Filename, Line: line, Message: fmt.Sprintf("%s can only be set in the main config file", section) })
+                }
+            }
+        }
+
+        for name := range source.Config.Servers {
+            duplicate(source, "servers", name)
+        }
+        for name := range source.Config.ACLs {
+            duplicate(source, "acls", name)
+        }
+        for name := range source.Config.Users {
+            duplicate(source, "users", name)
+        }
+        for group := range source.Config.GroupACLs {
+            duplicate(source, "group_acls", group)
+        }
+    }
+
+    for i, backend := range c.Global.AuthType {
+        if _, ok := authenticators[backend.Type]; ! ok && backend.Type != "none" {
+            add([]string{ "global", "auth_type" }, "unknown auth_type (%s) at position %d", backend.Type, i+1)
+        }
+        bc, err := backendConfig(c, backend)
+        if err != nil {
+            add([]string{ "global", "auth_type" }, "auth_type at position %d: %s", i+1, err)
+            continue
+        }
+        if backend.Type == "webhook" && bc.Global.WebhookURL != c.Global.WebhookURL {
+            if err := checkWebhookURL(bc.Global.WebhookURL); err != nil {
+                add([]string{ "global", "auth_type" }, "invalid webhook_url (%s) for auth_type at position %d: %s", bc.Global.WebhookURL, i+1, err)
+            }
+        }
+        if backend.Type == "local" && bc.Global.LocalPasswordFile != c.Global.LocalPasswordFile {
+            if data, err := ioutil.ReadFile(bc.Global.LocalPasswordFile); err != nil {
+                add([]string{ "global", "auth_type" }, "unreadable local_password_file for auth_type at position %d: %s", i+1, err)
+            } else if _, err := parseLocalPasswordFile(data); err != nil {
+                add([]string{ "global", "auth_type" }, "invalid local_password_file (%s): %s", bc.Global.LocalPasswordFile, err)
+            }
+        }
+    }
+    switch c.Global.AuthMode {
+        case "", "any", "all":
+        default:
+            add([]string{ "global", "auth_mode" }, "unknown auth_mode (%s)", c.Global.AuthMode)
+    }
+
+    for _, keyPath := range c.Global.HostKeyPaths {
+        path := []string{ "global", "host_keys", keyPath }
+        if keyData, err := ioutil.ReadFile(keyPath); err != nil {
+            add(path, "unreadable host key: %s", err)
+        } else if _, err := ssh.ParsePrivateKey(keyData); err != nil {
+            add(path, "invalid host key (%s): %s", keyPath, err)
+        }
+    }
+
+    if len(c.Global.WebhookURL) > 0 {
+        if err := checkWebhookURL(c.Global.WebhookURL); err != nil {
+            add([]string{ "global", "webhook_url" }, "invalid webhook_url (%s): %s", c.Global.WebhookURL, err)
+        }
+    }
+
+    if len(c.Global.LocalPasswordFile) > 0 {
+        path := []string{ "global", "local_password_file" }
+        if data, err := ioutil.ReadFile(c.Global.LocalPasswordFile); err != nil {
+            add(path, "unreadable local_password_file: %s", err)
+        } else if _, err := parseLocalPasswordFile(data); err != nil {
+            add(path, "invalid local_password_file (%s): %s", c.Global.LocalPasswordFile, err)
+        }
+    }
+
+    for name, server := range c.Servers {
+        if err := checkConnectPath(server.ConnectPath); err != nil {
+            add([]string{ "servers", name, "connect_path" }, "server (%s) has invalid connect_path (%s), expected host:port: %s", name, server.ConnectPath, err)
+        }
+        if _, err := parseLoginUserTemplate(server.LoginUser); err != nil {
+            add([]string{ "servers", name, "login_user" }, "server (%s) has invalid login_user template: %s", name, err)
+        }
+        for user, loginUser := range server.UserMap {
+            if _, err := parseLoginUserTemplate(loginUser); err != nil {
+                add([]string{ "servers", name, "user_map", user }, "server (%s) has invalid user_map template for user (%s): %s", name, user, err)
+            }
+        }
+        for _, keyFile := range server.HostPubKeyFiles {
+            path := []string{ "servers", name, "host_pubkeys", keyFile }
+            if keyData, err := ioutil.ReadFile(keyFile); err != nil {
+                add(path, "server (%s) has unreadable host pubkey: %s", name, err)
+            } else if _, _, _, _, err := ssh.ParseAuthorizedKey(keyData); err != nil {
+                add(path, "server (%s) has invalid host pubkey (%s): %s", name, keyFile, err)
+            }
+        }
+    }
+
+    for name, acl := range c.ACLs {
+        for _, list := range []string{ "allow_list", "deny_list" } {
+            rules := acl.AllowedServers
+            if list == "deny_list" {
+                rules = acl.DeniedServers
+            }
+            for _, rule := range rules {
+                if err := checkServerRule(c, rule); err != nil {
+                    add([]string{ "acls", name, list, rule }, "acl (%s) has invalid %s entry: %s", name, list, err)
+                }
+            }
+        }
+        for _, loginUser := range acl.LoginUsers {
+            if _, err := parseLoginUserTemplate(loginUser); err != nil {
+                add([]string{ "acls", name, "login_users", loginUser }, "acl (%s) has invalid login_users template: %s", name, err)
+            }
+        }
+        if err := checkAuthMethods(acl.AuthMethods); err != nil {
+            add([]string{ "acls", name, "auth_methods" }, "acl (%s) has invalid auth_methods: %s", name, err)
+        }
+        checkSources([]string{ "acls", name }, "acl", name, acl.AllowedSources)
+        checkTimeWindow([]string{ "acls", name }, "acl", name, acl.SSHConfigTimeWindow)
+    }
+
+    for name, user := range c.Users {
+        if _, ok := c.ACLs[user.ACL]; len(user.ACL) > 0 && ! ok {
+            add([]string{ "users", name, "acl" }, "user (%s) has unknown acl (%s)", name, user.ACL)
+        }
+        if len(user.AuthorizedKeysFile) > 0 {
+            if _, err := ioutil.ReadFile(user.AuthorizedKeysFile); err != nil {
+                add([]string{ "users", name, "authorized_keys_file" }, "user (%s) has unreadable authorized_keys_file: %s", name, err)
+            }
+        }
+        if err := checkAuthMethods(user.AuthMethods); err != nil {
+            add([]string{ "users", name, "auth_methods" }, "user (%s) has invalid auth_methods: %s", name, err)
+        }
+        checkSources([]string{ "users", name }, "user", name, user.AllowedSources)
+        checkTimeWindow([]string{ "users", name }, "user", name, user.SSHConfigTimeWindow)
+    }
+
+    for group, acl := range c.GroupACLs {
+        if _, ok := c.ACLs[acl]; len(acl) > 0 && ! ok {
+            add([]string{ "group_acls", group }, "group (%s) maps to unknown acl (%s)", group, acl)
+        }
+        if ! c.Global.GroupACLsMatchCN && ! strings.Contains(group, "=") {
+            add([]string{ "group_acls", group }, "group (%s) isn't a full DN, which is required unless group_acls_match_cn is set", group)
+        }
+    }
+
+    sortProblems(problems, sources)
+    return problems
+}
+
+// Returns a problem located in the file that defines the key path, or the
+// most of it, at the line of the key or else of its nearest parent.
+func locateProblem(sources []configSource, path []string, message string) configProblem {
+    problem := configProblem{ File: sources[0].Filename, Message: message }
+    found := 0
+    for _, source := range sources {
+        if line, depth := configPosition(source.Data, path); depth > found {
+            problem.File = source.Filename
+            problem.Line = line
+            found = depth
+        }
+    }
+    return problem
+}
+
+// Sorts problems by the order of their files, then by line.
+func sortProblems(problems []configProblem, sources []configSource) {
+    order := map[string]int{}
+    for i, source := range sources {
+        order[source.Filename] = i
+    }
+    sort.Slice(problems, func(i, j int) bool {
+        if problems[i].File != problems[j].File {
+            return order[problems[i].File] < order[problems[j].File]
+        }
+        if problems[i].Line != problems[j].Line {
+            return problems[i].Line < problems[j].Line
+        }
+        return problems[i].Message < problems[j].Message
+    })
+}
+
+// Loads and validates a config file (and those it includes), returning it
+// with the problems found. An error is only returned if a file can't be read
+// or parsed at all.
+func checkConfigFile(filename string) (*SSHConfig, []configProblem, error) {
+    c, sources, err := readConfigFiles(filename)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    // The rest of the checks would only add noise about the values left empty.
+    if errs := interpolateConfig(c); len(errs) > 0 {
+        var problems []configProblem
+        for _, e := range errs {
+            problems = append(problems, locateProblem(sources, e.Path, e.Err.Error()))
+        }
+        sortProblems(problems, sources)
+        return c, problems, nil
+    }
+
+    return c, validateConfig(c, sources), nil
+}
+
+type checkConfigCommand struct {
+    Dump        bool        `long:"dump" description:"Print the merged config, without resolving references or showing secrets"`
+}
+
+// Validates the config file, printing each problem found.
+func (c *checkConfigCommand) Execute(args []string) error {
+    if c.Dump {
+        return dumpConfig(opts.Config)
+    }
+
+    _, problems, err := checkConfigFile(opts.Config)
+    if err != nil {
+        return err
+    }
+
+    for _, problem := range problems {
+        fmt.Println(problem)
+    }
+    if len(problems) > 0 {
+        return fmt.Errorf("%d problem(s) found in %s", len(problems), opts.Config)
+    }
+
+    fmt.Printf("%s: OK\n", opts.Config)
+    return nil
+}
+
+// Prints the config and its includes merged into one. References are shown
+// as written rather than resolved, and other secrets are redacted.
+func dumpConfig(filename string) error {
+    c, _, err := readConfigFiles(filename)
+    if err != nil {
+        return err
+    }
+    redactConfig(c)
+
+    data, err := yaml.Marshal(c)
+    if err != nil {
+        return err
+    }
+    fmt.Print(string(data))
+    return nil
+}
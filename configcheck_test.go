@@ -0,0 +1,111 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+)
+
+var testMainConfig = []byte(`include: ["servers.yaml"]
+global:
+    host_keys: ["/etc/a", "/etc/b"]
+    auth_type:
+        - "ad"
+        - type: "local"
+          local_password_file: "/etc/pw"
+servers:
+    vdev1: { connect_path: "vdev1:22" }
+`)
+
+var testIncludedConfig = []byte(`servers:
+    vdev2:
+        connect_path: "vdev2"
+`)
+
+func TestConfigPosition(t *testing.T) {
+    for _, test := range []struct {
+        path        []string
+        line        int
+        depth       int
+    }{
+        { []string{ "global", "host_keys", "/etc/b" }, 3, 3 },
+        { []string{ "global", "auth_type", "local_password_file" }, 7, 3 },
+        { []string{ "servers", "vdev1", "connect_path" }, 9, 3 },
+        { []string{ "servers", "vdev1", "login_user" }, 9, 2 },
+        { []string{ "users", "alice" }, 0, 0 },
+    } {
+        line, depth := configPosition(testMainConfig, test.path)
+        if line != test.line || depth != test.depth {
+            t.Errorf("%v: expected line %d depth %d, got line %d depth %d", test.path, test.line, test.depth, line, depth)
+        }
+    }
+}
+
+func TestLocateProblem(t *testing.T) {
+    sources := []configSource{
+        { Filename: "main.yaml", Data: testMainConfig },
+        { Filename: "servers.yaml", Data: testIncludedConfig },
+    }
+
+    for _, test := range []struct {
+        path        []string
+        file        string
+        line        int
+    }{
+        { []string{ "servers", "vdev2", "connect_path" }, "servers.yaml", 3 },
+        { []string{ "servers", "vdev2", "tags" }, "servers.yaml", 2 },
+        { []string{ "global", "host_keys", "/etc/a" }, "main.yaml", 3 },
+        { []string{ "acls", "admins" }, "main.yaml", 0 },
+    } {
+        problem := locateProblem(sources, test.path, "problem")
+        if problem.File != test.file || problem.Line != test.line {
+            t.Errorf("%v: expected %s line %d, got %s line %d", test.path, test.file, test.line, problem.File, problem.Line)
+        }
+    }
+}
+
+func TestCheckConfigSourcesAndWindows(t *testing.T) {
+    filename := filepath.Join(t.TempDir(), "config.yaml")
+    ioutil.WriteFile(filename, []byte(`servers:
+    vdev1: { connect_path: "vdev1:22" }
+acls:
+    admins:
+        allow_list: [ "vdev1" ]
+        allowed_sources:
+            - "10.0.0.0/8, 192.168.1.300"
+            - "2001:db8::/32"
+        schedule:
+            - "Mon-Fri 09:00-17:00"
+            - "Mon 9:00x-10:00"
+users:
+    alice:
+        acl: "admins"
+        allowed_sources: [ "198.51.100.0/33" ]
+        valid_from: "2026-13-01"
+        time_zone: "Nowhere/Special"
+`), 0600)
+
+    _, problems, err := checkConfigFile(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    expected := map[int]string{
+        7:  "acl (admins) has invalid allowed_sources",
+        11: "acl (admins) has an invalid schedule",
+        15: "user (alice) has invalid allowed_sources",
+        16: "user (alice) has an invalid valid_from",
+        17: "user (alice) has an invalid time window",
+    }
+    for _, problem := range problems {
+        if prefix, ok := expected[problem.Line]; ok && strings.HasPrefix(problem.Message, prefix) {
+            delete(expected, problem.Line)
+        } else {
+            t.Errorf("Unexpected problem %s", problem)
+        }
+    }
+    for line, prefix := range expected {
+        t.Errorf("Expected a problem on line %d: %s", line, prefix)
+    }
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+// How long a credential stored during authentication is kept if the
+// connection never completes its handshake (e.g. a failed second factor).
+const unclaimedCredentialTTL = 5 * time.Minute
+
+type storedCredential struct {
+    secret      []byte
+    claimed     bool
+}
+
+// Holds secrets needed later in a connection (pass-through passwords), keyed
+// by SSH session ID, so they aren't kept in the connection's ssh.Permissions.
+type CredentialStore struct {
+    credentials     map[string]*storedCredential
+    ttl             time.Duration
+    mutex           *sync.Mutex
+}
+
+var credentials = NewCredentialStore()
+
+func NewCredentialStore() *CredentialStore {
+    return &CredentialStore{
+        credentials:    map[string]*storedCredential{},
+        ttl:            unclaimedCredentialTTL,
+        mutex:          &sync.Mutex{},
+    }
+}
+
+// Stores a secret during authentication. It is swept after a while unless
+// the handshake completes and the connection claims it.
+func (c *CredentialStore) Put(sessionID []byte, secret []byte) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    key := string(sessionID)
+    c.clear(key)
+
+    cred := &storedCredential{ secret: append([]byte{}, secret...) }
+    c.credentials[key] = cred
+
+    time.AfterFunc(c.ttl, func() {
+        c.mutex.Lock()
+        defer c.mutex.Unlock()
+
+        if c.credentials[key] == cred && ! cred.claimed {
+            c.clear(key)
+        }
+    })
+}
+
+// Marks the credential as belonging to an established connection,
+// which is then responsible for clearing it.
+func (c *CredentialStore) Claim(sessionID []byte) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if cred, ok := c.credentials[string(sessionID)]; ok {
+        cred.claimed = true
+    }
+}
+
+func (c *CredentialStore) Get(sessionID []byte) (string, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if cred, ok := c.credentials[string(sessionID)]; ok {
+        return string(cred.secret), true
+    }
+    return "", false
+}
+
+func (c *CredentialStore) Clear(sessionID []byte) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    c.clear(string(sessionID))
+}
+
+func (c *CredentialStore) clear(key string) {
+    if cred, ok := c.credentials[key]; ok {
+        for i := range cred.secret {
+            cred.secret[i] = 0
+        }
+        delete(c.credentials, key)
+    }
+}
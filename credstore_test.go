@@ -0,0 +1,57 @@
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+func TestCredentialStoreClaim(t *testing.T) {
+    store := NewCredentialStore()
+    store.ttl = 50 * time.Millisecond
+    sessionID := []byte("session")
+
+    store.Put(sessionID, []byte("secret"))
+    store.Claim(sessionID)
+    time.Sleep(100 * time.Millisecond)
+
+    if secret, ok := store.Get(sessionID); ! ok || secret != "secret" {
+        t.Errorf("Expected a claimed password to be kept, got %q, %v", secret, ok)
+    }
+
+    stored := store.credentials[string(sessionID)].secret
+    store.Clear(sessionID)
+    if _, ok := store.Get(sessionID); ok {
+        t.Errorf("Expected the password to be cleared")
+    }
+    for _, b := range stored {
+        if b != 0 {
+            t.Fatalf("Expected the cleared password to be zeroed")
+        }
+    }
+}
+
+// A handshake that never completes (e.g. a failed second factor) leaves the
+// password unclaimed.
+func TestCredentialStoreSweep(t *testing.T) {
+    store := NewCredentialStore()
+    store.ttl = 200 * time.Millisecond
+
+    store.Put([]byte("failed"), []byte("secret"))
+    if _, ok := store.Get([]byte("failed")); ! ok {
+        t.Fatalf("Expected the password to be stored until the handshake completes")
+    }
+
+    // A later attempt on the same session replaces the first, and isn't
+    // swept by the first one's timer.
+    time.Sleep(120 * time.Millisecond)
+    store.Put([]byte("failed"), []byte("retry"))
+    time.Sleep(120 * time.Millisecond)
+    if secret, ok := store.Get([]byte("failed")); ! ok || secret != "retry" {
+        t.Errorf("Expected the second password to be kept, got %q, %v", secret, ok)
+    }
+
+    time.Sleep(300 * time.Millisecond)
+    if _, ok := store.Get([]byte("failed")); ok {
+        t.Errorf("Expected an unclaimed password to be swept")
+    }
+}
@@ -19,7 +19,9 @@ type rw struct {
 	io.Writer
 }
 
-func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn, newChannel ssh.NewChannel, chans <-chan ssh.NewChannel) {
+// Relays a session to the chosen server. The config is the snapshot the
+// connection authenticated with, kept even if the config is reloaded.
+func (s *SSHServer) SessionForward(config *SSHConfig, startTime time.Time, sshConn *ssh.ServerConn, target userTarget, newChannel ssh.NewChannel, chans <-chan ssh.NewChannel) {
     rawsesschan, sessReqs, err := newChannel.Accept()
     if err != nil {
         log.Printf("Unable to Accept Session, closing connection...")
@@ -37,6 +39,7 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
                 return
             }
 
+            // Port forwarding (direct-tcpip) is never relayed, so no-port-forwarding always holds.
             newChannel.Reject(ssh.Prohibited, "remote server denied channel request")
             continue
         }
@@ -52,6 +55,13 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
         // or a double reply will cause a fatal error client side.
         for req := range sessReqs {
             sesschan.LogRequest(req)
+            if sessionRequestDenied(sshConn.Permissions, req.Type) {
+                // Denied by the key options or certificate used to authenticate.
+                if req.WantReply {
+                    req.Reply(false, []byte{})
+                }
+                continue
+            }
             if req.Type == "auth-agent-req@openssh.com" {
                 agentForwarding = true
                 if req.WantReply {
@@ -72,56 +82,113 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
     // Set the window header to SSH Relay login.
     fmt.Fprintf(sesschan, "%s]0;SSH Bastion Relay Login%s", []byte{27}, []byte{7})
 
-    fmt.Fprintf(sesschan, "%s\r\n", GetMOTD())
+    fmt.Fprintf(sesschan, "%s\r\n", GetMOTD(config))
 
     var remote SSHConfigServer
     var remote_name string
 
-    if user, ok := config.Users[sshConn.User()]; ! ok {
+    allowedServers, err := permittedServers(config, sshConn, sshConn.Permissions)
+    if err != nil {
+        fmt.Fprintf(sesschan, "Error processing server selection (Invalid ACL).\r\n")
+        log.Printf("%s detected for user %s.", err, sshConn.User())
+        sesschan.Close()
+        return
+    } else if len(allowedServers) == 0 {
         fmt.Fprintf(sesschan, "User has no permitted remote hosts.\r\n")
         sesschan.Close()
         return
     } else {
-        if acl, ok := config.ACLs[user.ACL]; ! ok {
-            fmt.Fprintf(sesschan, "Error processing server selection (Invalid ACL).\r\n")
-            log.Printf("Invalid ACL detected for user %s.", sshConn.User())
-            sesschan.Close()
-            return
+        var svr string
+        if forced := sshConn.Permissions.CriticalOptions["force-command"]; len(forced) > 0 {
+            // Certificates with a force-command, or keys with a command="", may only connect to that server.
+            if ! containsString(allowedServers, forced) {
+                fmt.Fprintf(sesschan, "Forced server (%s) is not permitted.\r\n", forced)
+                log.Printf("Forced server (%s) not permitted by ACL for user %s.", forced, sshConn.User())
+                sesschan.Close()
+                return
+            }
+            svr = forced
+        } else if len(target.Server) > 0 {
+            // A server named in the username skips the menu.
+            if svr = resolveTargetServer(target.Server, allowedServers); len(svr) == 0 {
+                fmt.Fprintf(sesschan, "Requested server (%s) is not permitted.\r\n", target.Server)
+                log.Printf("Requested server (%s) not permitted by ACL for user %s.", target.Server, sshConn.User())
+                sesschan.Close()
+                return
+            }
         } else {
-            svr, err := InteractiveSelection(sesschan, "Please choose from the following servers:", acl.AllowedServers)
+            svr, err = InteractiveSelection(sesschan, "Please choose from the following servers:", "Please Enter A Server ID: ", allowedServers)
             if err != nil {
                 fmt.Fprintf(sesschan, "Error processing server selection.\r\n")
                 sesschan.Close()
                 return
             }
+        }
 
-            if server, ok := config.Servers[svr]; ! ok {
-                fmt.Fprintf(sesschan, "Incorrectly Configured Server Selected.\r\n")
-                sesschan.Close()
-                return
-            } else {
-                remote_name = svr
-                remote = server
-            }
+        // A time window may have closed while the menu was open.
+        if allowed, _ := permittedServers(config, sshConn, sshConn.Permissions); ! containsString(allowed, svr) {
+            fmt.Fprintf(sesschan, "Selected server (%s) is no longer permitted.\r\n", svr)
+            sesschan.Close()
+            return
+        }
+
+        if server, ok := config.Servers[svr]; ! ok {
+            fmt.Fprintf(sesschan, "Incorrectly Configured Server Selected.\r\n")
+            sesschan.Close()
+            return
+        } else {
+            remote_name = svr
+            remote = server
+        }
+    }
+
+    loginUsers, err := allowedLoginUsers(config, sshConn, sshConn.Permissions, remote_name)
+    if err != nil {
+        fmt.Fprintf(sesschan, "Unable to determine the remote login user.\r\n")
+        log.Printf("%s for server %s and user %s.", err, remote_name, sshConn.User())
+        sesschan.Close()
+        return
+    }
+
+    // Servers allowing more than one account ask which to log in as.
+    loginUser := loginUsers[0]
+    if len(target.LoginUser) > 0 {
+        if ! containsString(loginUsers, target.LoginUser) {
+            fmt.Fprintf(sesschan, "Requested account (%s) is not permitted on %s.\r\n", target.LoginUser, remote_name)
+            log.Printf("Requested account (%s) on %s not permitted for user %s.", target.LoginUser, remote_name, sshConn.User())
+            sesschan.Close()
+            return
+        }
+        loginUser = target.LoginUser
+    } else if len(loginUsers) > 1 {
+        loginUser, err = InteractiveSelection(sesschan, fmt.Sprintf("Please choose the account to log in to %s as:", remote_name), "Please Enter An Account ID: ", loginUsers)
+        if err != nil {
+            fmt.Fprintf(sesschan, "Error processing account selection.\r\n")
+            sesschan.Close()
+            return
         }
     }
 
-    err = sesschan.SyncToFile(remote_name)
+    err = sesschan.SyncToFile(config.Global.LogPath, remote_name, loginUser)
     if err != nil {
         fmt.Fprintf(sesschan, "Failed to Initialize Session.\r\n")
         sesschan.Close()
         return
     }
 
-    WriteAuthLog("Connecting to remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
-    fmt.Fprintf(sesschan, "Connecting to %s\r\n", remote_name)
+    WriteAuthLog("Connecting to remote for relay (%s) as %s by %s from %s.", remote.ConnectPath, loginUser, sshConn.User(), sshConn.RemoteAddr())
+    fmt.Fprintf(sesschan, "Connecting to %s as %s\r\n", remote_name, loginUser)
+
+    // Set when the relay issues its own certificate for the remote login,
+    // in which case the user's password is never passed through.
+    var upstreamCert bool = false
 
     var clientConfig *ssh.ClientConfig
     clientConfig = &ssh.ClientConfig{
-        User:               sshConn.User(),
+        User:               loginUser,
         Auth:               []ssh.AuthMethod{
             ssh.PasswordCallback(func() (secret string, err error) {
-                if secret, ok := sshConn.Permissions.Extensions["password"]; ok && config.Global.PassPassword {
+                if secret, ok := credentials.Get(sshConn.SessionID()); ok && config.Global.PassPassword && ! upstreamCert {
                     return secret, nil
                 } else {
                     //log.Printf("Prompting for password for remote...")
@@ -156,10 +223,6 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
         },
     }
 
-    if len(remote.LoginUser) > 0 {
-        clientConfig.User = remote.LoginUser
-    }
-
     // Set up the agent
     if agentForwarding {
         agentChan, agentReqs, err := sshConn.OpenChannel("auth-agent@openssh.com", nil)
@@ -175,6 +238,18 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
         }
     }
 
+    // Issue a short-lived certificate for the remote login, tried before any other method.
+    if len(config.Global.UpstreamCAKey) > 0 {
+        certSigner, cert, err := MintUpstreamCert(config, clientConfig.User, sshConn.User(), remote_name)
+        if err != nil {
+            log.Printf("Unable to issue upstream certificate for remote (%s): %s", remote_name, err)
+        } else {
+            upstreamCert = true
+            WriteAuthLog("Issued upstream certificate (Serial: %d) for %s on remote %s by %s from %s.", cert.Serial, clientConfig.User, remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
+            clientConfig.Auth = append([]ssh.AuthMethod{ ssh.PublicKeys(certSigner) }, clientConfig.Auth...)
+        }
+    }
+
     log.Printf("Getting Ready to Dial Remote SSH %s", remote_name)
     client, err := ssh.Dial("tcp", remote.ConnectPath, clientConfig)
     if err != nil {
@@ -185,6 +260,9 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
     defer client.Close()
     log.Printf("Dialled Remote SSH Successfully...")
 
+    // The pass-through password is no longer needed.
+    credentials.Clear(sshConn.SessionID())
+
     // Forward the session channel
     log.Printf("Setting up channel to remote %s", remote_name)
     channel2, reqs2, err := client.OpenChannel("session", []byte{})
@@ -196,6 +274,13 @@ func (s *SSHServer) SessionForward(startTime time.Time, sshConn *ssh.ServerConn,
     WriteAuthLog("Connected to remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
     defer WriteAuthLog("Disconnected from remote for relay (%s) by %s from %s.", remote.ConnectPath, sshConn.User(), sshConn.RemoteAddr())
 
+    // End the session when the time window permitting it closes, if configured to.
+    if endsSessions(config, sshConn, sshConn.Permissions, remote_name) {
+        done := make(chan struct{})
+        defer close(done)
+        go watchSessionWindow(config, sshConn, remote_name, sesschan, done)
+    }
+
     log.Printf("Starting session proxy...")
     proxy(maskedReqs, reqs2, sesschan, channel2)
 }
@@ -7,8 +7,8 @@ import (
     "golang.org/x/crypto/ssh/terminal"
 )
 
-func InteractiveSelection(c io.ReadWriter, prompt string, choices []string) (string, error) {
-    t := terminal.NewTerminal(c, "Please Enter A Server ID: ")
+func InteractiveSelection(c io.ReadWriter, prompt string, entryPrompt string, choices []string) (string, error) {
+    t := terminal.NewTerminal(c, entryPrompt)
 
     fmt.Fprintf(c, "%s\r\n", prompt)
     for i, v := range choices {
@@ -35,7 +35,7 @@ func InteractiveSelection(c io.ReadWriter, prompt string, choices []string) (str
             continue
         }
 
-        if (i < 0) || (i > len(choices)) {
+        if (i < 1) || (i > len(choices)) {
             continue
         } else {
             return choices[(i-1)], err
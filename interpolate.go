@@ -0,0 +1,147 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "reflect"
+    "regexp"
+    "strings"
+    "io/ioutil"
+)
+
+// Placeholder for secrets left out of a config dump.
+const redactedValue = "<redacted>"
+
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// A reference that couldn't be resolved, at the key path of the value.
+type interpolationError struct {
+    Path        []string
+    Err         error
+}
+
+type interpolator struct {
+    strict      bool
+    errors      []interpolationError
+}
+
+func isConfigReference(value string) bool {
+    return strings.HasPrefix(value, "file:") || envReference.MatchString(value)
+}
+
+// Only fails on undefined references in strict mode, otherwise they resolve
+// to an empty string.
+func (r *interpolator) fail(path []string, err error) {
+    if r.strict {
+        r.errors = append(r.errors, interpolationError{ Path: path, Err: err })
+    } else {
+        log.Printf("Config value at %s: %s, using an empty value", strings.Join(path, "."), err)
+    }
+}
+
+// Resolves a "file:/path" value to the contents of the file (less any
+// trailing newline), and ${NAME} within a value to the environment variable.
+func (r *interpolator) resolve(value string, path []string) string {
+    if strings.HasPrefix(value, "file:") {
+        data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+        if err != nil {
+            r.fail(path, fmt.Errorf("Unable to read file reference: %s", err))
+            return ""
+        }
+        return strings.TrimRight(string(data), "\r\n")
+    }
+
+    return envReference.ReplaceAllStringFunc(value, func(ref string) string {
+        name := envReference.FindStringSubmatch(ref)[1]
+        env, ok := os.LookupEnv(name)
+        if ! ok {
+            r.fail(path, fmt.Errorf("Undefined environment variable (%s)", name))
+        }
+        return env
+    })
+}
+
+// Walks the config, resolving every string value. The path of each value is
+// tracked by its YAML keys, to report where a reference failed.
+func (r *interpolator) walk(v reflect.Value, path []string) {
+    switch v.Kind() {
+        case reflect.String:
+            if v.CanSet() {
+                v.SetString(r.resolve(v.String(), path))
+            }
+        case reflect.Ptr:
+            if ! v.IsNil() {
+                r.walk(v.Elem(), path)
+            }
+        case reflect.Interface:
+            // Backend settings hold any YAML value, resolve a copy of it.
+            if ! v.IsNil() && v.CanSet() {
+                elem := reflect.New(v.Elem().Type()).Elem()
+                elem.Set(v.Elem())
+                r.walk(elem, path)
+                v.Set(elem)
+            }
+        case reflect.Struct:
+            for i := 0; i < v.NumField(); i++ {
+                tag := strings.Split(v.Type().Field(i).Tag.Get("yaml"), ",")
+                if len(tag[0]) == 0 {
+                    // Inline structs share the path of their parent.
+                    r.walk(v.Field(i), path)
+                } else {
+                    r.walk(v.Field(i), append(append([]string{}, path...), tag[0]))
+                }
+            }
+        case reflect.Slice:
+            for i := 0; i < v.Len(); i++ {
+                elemPath := path
+                if v.Index(i).Kind() == reflect.String {
+                    elemPath = append(append([]string{}, path...), v.Index(i).String())
+                }
+                r.walk(v.Index(i), elemPath)
+            }
+        case reflect.Map:
+            // Map values aren't addressable, so resolve a copy and store it back.
+            for _, key := range v.MapKeys() {
+                elem := reflect.New(v.Type().Elem()).Elem()
+                elem.Set(v.MapIndex(key))
+                r.walk(elem, append(append([]string{}, path...), fmt.Sprint(key.Interface())))
+                v.SetMapIndex(key, elem)
+            }
+    }
+}
+
+// Resolves the ${NAME} and file: references in the config's string values.
+// With strict_interpolation set, the references that couldn't be resolved are
+// returned, otherwise they are logged and left empty.
+func interpolateConfig(c *SSHConfig) []interpolationError {
+    r := &interpolator{ strict: c.Global.StrictInterpolation }
+    r.walk(reflect.ValueOf(c), nil)
+    return r.errors
+}
+
+// Replaces secrets set directly in the config, rather than by reference,
+// for a config that hasn't been interpolated to be shown.
+func redactConfig(c *SSHConfig) {
+    redact := func(value *string) {
+        if len(*value) > 0 && ! isConfigReference(*value) {
+            *value = redactedValue
+        }
+    }
+
+    redact(&c.Global.LDAP_BindPassword)
+    redact(&c.Global.RADIUS_Secret)
+    redact(&c.Global.WebhookSecret)
+    for _, backend := range c.Global.AuthType {
+        for _, key := range []string{ "ldap_bind_password", "radius_secret", "webhook_secret" } {
+            if value, ok := backend.Settings[key].(string); ok {
+                redact(&value)
+                backend.Settings[key] = value
+            }
+        }
+    }
+    for name, user := range c.Users {
+        redact(&user.TOTPSecret)
+        c.Users[name] = user
+    }
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+    "fmt"
+    "bytes"
+    "math/big"
+    "io/ioutil"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/binary"
+    "golang.org/x/crypto/ssh"
+)
+
+// OpenSSH key revocation list, see PROTOCOL.krl in the OpenSSH sources.
+const krlMagic = "SSHKRL\n\x00"
+
+const (
+    krlSectionCertificates      = 1
+    krlSectionExplicitKey       = 2
+    krlSectionFingerprintSHA1   = 3
+    krlSectionSignatures        = 4
+    krlSectionFingerprintSHA256 = 5
+
+    krlCertSerialList           = 0x20
+    krlCertSerialRange          = 0x21
+    krlCertSerialBitmap         = 0x22
+    krlCertKeyID                = 0x23
+)
+
+type krlSerialRange struct {
+    min         uint64
+    max         uint64
+}
+
+type krlCertSection struct {
+    // Marshalled CA key, empty if the section applies to any CA.
+    caKey       []byte
+    serials     []krlSerialRange
+    bitmaps     []krlBitmap
+    keyIDs      map[string]bool
+}
+
+type krlBitmap struct {
+    offset      uint64
+    bits        *big.Int
+}
+
+type RevocationList struct {
+    keys        map[string]bool
+    sha1        map[string]bool
+    sha256      map[string]bool
+    certs       []*krlCertSection
+}
+
+type krlReader struct {
+    data        []byte
+}
+
+func (r *krlReader) uint64() (uint64, error) {
+    if len(r.data) < 8 {
+        return 0, fmt.Errorf("KRL truncated")
+    }
+    v := binary.BigEndian.Uint64(r.data)
+    r.data = r.data[8:]
+    return v, nil
+}
+
+func (r *krlReader) uint32() (uint32, error) {
+    if len(r.data) < 4 {
+        return 0, fmt.Errorf("KRL truncated")
+    }
+    v := binary.BigEndian.Uint32(r.data)
+    r.data = r.data[4:]
+    return v, nil
+}
+
+func (r *krlReader) byte() (byte, error) {
+    if len(r.data) < 1 {
+        return 0, fmt.Errorf("KRL truncated")
+    }
+    v := r.data[0]
+    r.data = r.data[1:]
+    return v, nil
+}
+
+func (r *krlReader) string() ([]byte, error) {
+    l, err := r.uint32()
+    if err != nil {
+        return nil, err
+    }
+    if uint32(len(r.data)) < l {
+        return nil, fmt.Errorf("KRL truncated")
+    }
+    v := r.data[:l]
+    r.data = r.data[l:]
+    return v, nil
+}
+
+func newRevocationList() *RevocationList {
+    return &RevocationList{
+        keys:       map[string]bool{},
+        sha1:       map[string]bool{},
+        sha256:     map[string]bool{},
+    }
+}
+
+// Loads a revoked keys file, either a binary OpenSSH KRL or a plain list of
+// public keys in authorized_keys format.
+func LoadRevocationList(filename string) (*RevocationList, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, fmt.Errorf("Unable to read revoked keys file (%s): %s", filename, err)
+    }
+
+    krl := newRevocationList()
+
+    if ! bytes.HasPrefix(data, []byte(krlMagic)) {
+        for len(bytes.TrimSpace(data)) > 0 {
+            var key ssh.PublicKey
+            key, _, _, data, err = ssh.ParseAuthorizedKey(data)
+            if err != nil {
+                return nil, fmt.Errorf("Error while processing revoked keys file (%s): %s", filename, err)
+            }
+            krl.keys[string(key.Marshal())] = true
+        }
+        return krl, nil
+    }
+
+    if err := krl.parse(data[len(krlMagic):]); err != nil {
+        return nil, fmt.Errorf("Error while processing KRL (%s): %s", filename, err)
+    }
+
+    return krl, nil
+}
+
+func (krl *RevocationList) parse(data []byte) error {
+    r := &krlReader{ data: data }
+
+    version, err := r.uint32()
+    if err != nil {
+        return err
+    }
+    if version != 1 {
+        return fmt.Errorf("Unsupported KRL format version %d", version)
+    }
+
+    // krl_version, generated_date, flags, reserved, comment
+    for i := 0; i < 3; i++ {
+        if _, err := r.uint64(); err != nil {
+            return err
+        }
+    }
+    for i := 0; i < 2; i++ {
+        if _, err := r.string(); err != nil {
+            return err
+        }
+    }
+
+    for len(r.data) > 0 {
+        sectionType, err := r.byte()
+        if err != nil {
+            return err
+        }
+        sectionData, err := r.string()
+        if err != nil {
+            return err
+        }
+        s := &krlReader{ data: sectionData }
+
+        switch sectionType {
+            case krlSectionCertificates:
+                if err := krl.parseCertSection(s); err != nil {
+                    return err
+                }
+            case krlSectionExplicitKey, krlSectionFingerprintSHA1, krlSectionFingerprintSHA256:
+                for len(s.data) > 0 {
+                    blob, err := s.string()
+                    if err != nil {
+                        return err
+                    }
+                    switch sectionType {
+                        case krlSectionExplicitKey:
+                            krl.keys[string(blob)] = true
+                        case krlSectionFingerprintSHA1:
+                            krl.sha1[string(blob)] = true
+                        case krlSectionFingerprintSHA256:
+                            krl.sha256[string(blob)] = true
+                    }
+                }
+            case krlSectionSignatures:
+                // Unlike the others this section has two strings, the signing
+                // key (read above) and the signature over the KRL, which isn't
+                // verified (as with sshd).
+                if _, err := r.string(); err != nil {
+                    return err
+                }
+            default:
+                return fmt.Errorf("Unsupported KRL section type %d", sectionType)
+        }
+    }
+
+    return nil
+}
+
+func (krl *RevocationList) parseCertSection(r *krlReader) error {
+    caKey, err := r.string()
+    if err != nil {
+        return err
+    }
+    if _, err := r.string(); err != nil {
+        return err
+    }
+
+    section := &krlCertSection{
+        caKey:      caKey,
+        keyIDs:     map[string]bool{},
+    }
+
+    for len(r.data) > 0 {
+        subType, err := r.byte()
+        if err != nil {
+            return err
+        }
+        subData, err := r.string()
+        if err != nil {
+            return err
+        }
+        s := &krlReader{ data: subData }
+
+        switch subType {
+            case krlCertSerialList:
+                for len(s.data) > 0 {
+                    serial, err := s.uint64()
+                    if err != nil {
+                        return err
+                    }
+                    section.serials = append(section.serials, krlSerialRange{ serial, serial })
+                }
+            case krlCertSerialRange:
+                min, err := s.uint64()
+                if err != nil {
+                    return err
+                }
+                max, err := s.uint64()
+                if err != nil {
+                    return err
+                }
+                section.serials = append(section.serials, krlSerialRange{ min, max })
+            case krlCertSerialBitmap:
+                offset, err := s.uint64()
+                if err != nil {
+                    return err
+                }
+                bits, err := s.string()
+                if err != nil {
+                    return err
+                }
+                section.bitmaps = append(section.bitmaps, krlBitmap{ offset, new(big.Int).SetBytes(bits) })
+            case krlCertKeyID:
+                for len(s.data) > 0 {
+                    id, err := s.string()
+                    if err != nil {
+                        return err
+                    }
+                    section.keyIDs[string(id)] = true
+                }
+            default:
+                return fmt.Errorf("Unsupported KRL certificate section type %d", subType)
+        }
+    }
+
+    krl.certs = append(krl.certs, section)
+    return nil
+}
+
+// Checks a plain public key against the explicit key and fingerprint sections.
+func (krl *RevocationList) IsKeyRevoked(key ssh.PublicKey) bool {
+    blob := key.Marshal()
+
+    if krl.keys[string(blob)] {
+        return true
+    }
+
+    sum1 := sha1.Sum(blob)
+    if krl.sha1[string(sum1[:])] {
+        return true
+    }
+
+    sum256 := sha256.Sum256(blob)
+    return krl.sha256[string(sum256[:])]
+}
+
+// Checks a certificate, its key and the CA that signed it.
+func (krl *RevocationList) IsCertRevoked(cert *ssh.Certificate) bool {
+    if krl.IsKeyRevoked(cert.Key) || krl.IsKeyRevoked(cert.SignatureKey) {
+        return true
+    }
+
+    caKey := cert.SignatureKey.Marshal()
+    for _, section := range krl.certs {
+        if len(section.caKey) > 0 && ! bytes.Equal(section.caKey, caKey) {
+            continue
+        }
+
+        if section.keyIDs[cert.KeyId] {
+            return true
+        }
+
+        for _, r := range section.serials {
+            if cert.Serial >= r.min && cert.Serial <= r.max {
+                return true
+            }
+        }
+
+        for _, b := range section.bitmaps {
+            if cert.Serial >= b.offset && cert.Serial - b.offset < uint64(b.bits.BitLen()) {
+                if b.bits.Bit(int(cert.Serial - b.offset)) == 1 {
+                    return true
+                }
+            }
+        }
+    }
+
+    return false
+}
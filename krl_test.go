@@ -0,0 +1,266 @@
+package main
+
+import (
+    "bytes"
+    "testing"
+    "io/ioutil"
+    "path/filepath"
+    "encoding/binary"
+    "golang.org/x/crypto/ssh"
+)
+
+// The fixtures in testdata/krl were made with OpenSSH's ssh-keygen:
+//
+//  ssh-keygen -k -f certs.krl -s ca.pub certs.spec
+//  ssh-keygen -k -f keys.krl keys.spec
+
+func loadTestKRLKey(t *testing.T, name string) ssh.PublicKey {
+    data, err := ioutil.ReadFile(filepath.Join("testdata", "krl", name + ".pub"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return key
+}
+
+func loadTestKRL(t *testing.T, name string) *RevocationList {
+    krl, err := LoadRevocationList(filepath.Join("testdata", "krl", name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    return krl
+}
+
+// Revocation is only checked against the CA key, serial, key ID and key,
+// so the certificates needn't be signed.
+func testKRLCert(key ssh.PublicKey, ca ssh.PublicKey, serial uint64, keyID string) *ssh.Certificate {
+    return &ssh.Certificate{
+        Key:            key,
+        CertType:       ssh.UserCert,
+        Serial:         serial,
+        KeyId:          keyID,
+        SignatureKey:   ca,
+    }
+}
+
+func TestKRLCertificates(t *testing.T) {
+    krl := loadTestKRL(t, "certs.krl")
+    ca, otherCA := loadTestKRLKey(t, "ca"), loadTestKRLKey(t, "other_ca")
+    key := loadTestKRLKey(t, "user1")
+
+    for _, test := range []struct {
+        ca          ssh.PublicKey
+        serial      uint64
+        keyID       string
+        revoked     bool
+    }{
+        { ca, 1, "alice", true },
+        { ca, 2, "alice", false },
+        { ca, 9, "alice", false },
+        { ca, 10, "alice", true },
+        { ca, 15, "alice", true },
+        { ca, 20, "alice", true },
+        { ca, 21, "alice", false },
+        { ca, 999, "alice", false },
+        { ca, 1000, "alice", true },
+        { ca, 1001, "alice", false },
+        { ca, 1003, "alice", true },
+        { ca, 1059, "alice", false },
+        { ca, 1060, "alice", true },
+        { ca, 1063, "alice", false },
+        { ca, 1 << 63, "alice", false },
+        { ca, 500, "revoked-id", true },
+        { otherCA, 1, "alice", false },
+        { otherCA, 1000, "alice", false },
+        { otherCA, 500, "revoked-id", false },
+    } {
+        if revoked := krl.IsCertRevoked(testKRLCert(key, test.ca, test.serial, test.keyID)); revoked != test.revoked {
+            t.Errorf("Serial %d, key ID %s, CA %s: expected revoked %v", test.serial, test.keyID, ssh.FingerprintSHA256(test.ca), test.revoked)
+        }
+    }
+
+    if krl.IsKeyRevoked(key) {
+        t.Errorf("Expected a plain key not to be revoked by a certificate section")
+    }
+}
+
+func TestKRLKeys(t *testing.T) {
+    krl := loadTestKRL(t, "keys.krl")
+    ca := loadTestKRLKey(t, "ca")
+
+    // user3 by key, user4 by SHA1, user5 and user6 by SHA256.
+    for name, revoked := range map[string]bool{
+        "user1": false,
+        "user2": false,
+        "user3": true,
+        "user4": true,
+        "user5": true,
+        "user6": true,
+    } {
+        key := loadTestKRLKey(t, name)
+        if krl.IsKeyRevoked(key) != revoked {
+            t.Errorf("%s: expected revoked %v", name, revoked)
+        }
+        if krl.IsCertRevoked(testKRLCert(key, ca, 1, name)) != revoked {
+            t.Errorf("%s: expected a certificate for the key to be revoked %v", name, revoked)
+        }
+    }
+
+    // A revoked CA revokes every certificate it signed.
+    if ! krl.IsCertRevoked(testKRLCert(loadTestKRLKey(t, "user1"), loadTestKRLKey(t, "user4"), 1, "user1")) {
+        t.Errorf("Expected a certificate signed by a revoked key to be revoked")
+    }
+}
+
+func TestKRLPlainKeys(t *testing.T) {
+    var data []byte
+    for _, name := range []string{ "user1", "user2" } {
+        key, err := ioutil.ReadFile(filepath.Join("testdata", "krl", name + ".pub"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        data = append(data, key...)
+    }
+    filename := filepath.Join(t.TempDir(), "revoked_keys")
+    ioutil.WriteFile(filename, data, 0600)
+
+    krl, err := LoadRevocationList(filename)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for name, revoked := range map[string]bool{ "user1": true, "user2": true, "user3": false } {
+        if krl.IsKeyRevoked(loadTestKRLKey(t, name)) != revoked {
+            t.Errorf("%s: expected revoked %v", name, revoked)
+        }
+    }
+}
+
+func krlString(data []byte) []byte {
+    b := make([]byte, 4, 4 + len(data))
+    binary.BigEndian.PutUint32(b, uint32(len(data)))
+    return append(b, data...)
+}
+
+func krlUint64(v uint64) []byte {
+    b := make([]byte, 8)
+    binary.BigEndian.PutUint64(b, v)
+    return b
+}
+
+func krlSection(sectionType byte, data ...[]byte) []byte {
+    return append([]byte{ sectionType }, krlString(bytes.Join(data, nil))...)
+}
+
+// Builds a KRL with the given (encoded) sections.
+func buildTestKRL(sections ...[]byte) []byte {
+    b := []byte(krlMagic)
+    b = append(b, 0, 0, 0, 1)
+    b = append(b, make([]byte, 24)...)
+    b = append(b, krlString(nil)...)
+    b = append(b, krlString([]byte("test"))...)
+    for _, section := range sections {
+        b = append(b, section...)
+    }
+    return b
+}
+
+func parseTestKRL(data []byte) (*RevocationList, error) {
+    krl := newRevocationList()
+    return krl, krl.parse(data[len(krlMagic):])
+}
+
+// Sections ssh-keygen doesn't produce: explicit keys, key IDs for any CA and
+// a signature.
+func TestKRLConstructed(t *testing.T) {
+    ca, otherCA := loadTestKRLKey(t, "ca"), loadTestKRLKey(t, "other_ca")
+    user1, user2 := loadTestKRLKey(t, "user1"), loadTestKRLKey(t, "user2")
+
+    krl, err := parseTestKRL(buildTestKRL(
+        krlSection(krlSectionExplicitKey, krlString(user1.Marshal())),
+        krlSection(krlSectionCertificates, krlString(nil), krlString(nil),
+            krlSection(krlCertKeyID, krlString([]byte("any-ca-id"))),
+            krlSection(krlCertSerialBitmap, krlUint64(64), krlString([]byte{ 0x01, 0x00, 0x05 }))),
+        append(krlSection(krlSectionSignatures, krlString(ca.Marshal())), krlString([]byte("signature"))...),
+    ))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if ! krl.IsKeyRevoked(user1) || krl.IsKeyRevoked(user2) {
+        t.Errorf("Expected only user1 to be revoked by the explicit key section")
+    }
+    for _, test := range []struct {
+        ca          ssh.PublicKey
+        serial      uint64
+        keyID       string
+        revoked     bool
+    }{
+        { ca, 1, "any-ca-id", true },
+        { otherCA, 1, "any-ca-id", true },
+        { otherCA, 1, "other-id", false },
+        // Bitmap 0x010005 from 64: bits 0, 2 and 16.
+        { ca, 64, "alice", true },
+        { otherCA, 65, "alice", false },
+        { otherCA, 66, "alice", true },
+        { ca, 80, "alice", true },
+        { ca, 81, "alice", false },
+        { ca, 63, "alice", false },
+    } {
+        if krl.IsCertRevoked(testKRLCert(user2, test.ca, test.serial, test.keyID)) != test.revoked {
+            t.Errorf("Serial %d, key ID %s: expected revoked %v", test.serial, test.keyID, test.revoked)
+        }
+    }
+}
+
+func TestKRLMalformed(t *testing.T) {
+    valid := krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialList, krlUint64(1)))
+
+    for name, data := range map[string][]byte{
+        "version":              append(append([]byte(krlMagic), 0, 0, 0, 2), buildTestKRL()[len(krlMagic) + 4:]...),
+        "section type":         buildTestKRL(valid, krlSection(9, nil)),
+        "cert section type":    buildTestKRL(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(0x30, nil))),
+        "section length":       buildTestKRL(append([]byte{ krlSectionExplicitKey }, 0xff, 0xff, 0xff, 0xff)),
+        "string length":        buildTestKRL(krlSection(krlSectionFingerprintSHA256, []byte{ 0, 0, 0, 40 }, make([]byte, 32))),
+        "serial list":          buildTestKRL(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialList, make([]byte, 7)))),
+        "serial range":         buildTestKRL(krlSection(krlSectionCertificates, krlString(nil), krlString(nil), krlSection(krlCertSerialRange, krlUint64(1)))),
+        "missing signature":    buildTestKRL(valid, krlSection(krlSectionSignatures, krlString(nil))),
+    } {
+        if _, err := parseTestKRL(data); err == nil {
+            t.Errorf("%s: expected an error", name)
+        }
+    }
+}
+
+// Returns the offsets at which a KRL's header and each section ends, where
+// it can be cut short and still be valid.
+func krlBoundaries(data []byte) map[int]bool {
+    off := len(krlMagic) + 4 + 24
+    for i := 0; i < 2; i++ {
+        off += 4 + int(binary.BigEndian.Uint32(data[off:]))
+    }
+    boundaries := map[int]bool{ off: true }
+    for off < len(data) {
+        off += 5 + int(binary.BigEndian.Uint32(data[off+1:]))
+        boundaries[off] = true
+    }
+    return boundaries
+}
+
+func TestKRLTruncated(t *testing.T) {
+    for _, name := range []string{ "certs.krl", "keys.krl" } {
+        data, err := ioutil.ReadFile(filepath.Join("testdata", "krl", name))
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        boundaries := krlBoundaries(data)
+        for n := len(krlMagic); n < len(data); n++ {
+            if _, err := parseTestKRL(data[:n]); ( err == nil ) != boundaries[n] {
+                t.Errorf("%s cut to %d bytes: unexpected result %v", name, n, err)
+            }
+        }
+    }
+}
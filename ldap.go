@@ -0,0 +1,263 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "strings"
+    "io/ioutil"
+    "crypto/tls"
+    "crypto/x509"
+    "golang.org/x/crypto/ssh"
+    ldap "github.com/tonnerre/go-ldap"
+)
+
+// Parses the configured LDAP server into a host:port address and the
+// transport security mode to use, "ldaps", "starttls" or "none".
+// A ldaps:// or ldap:// scheme on the server path takes precedence
+// over the ldap_tls option.
+func ldapServerAddr(c *SSHConfig) (string, string, error) {
+    addr := c.Global.LDAP_Server
+    mode := strings.ToLower(c.Global.LDAP_TLS)
+
+    if strings.HasPrefix(addr, "ldaps://") {
+        addr = strings.TrimPrefix(addr, "ldaps://")
+        mode = "ldaps"
+    } else if strings.HasPrefix(addr, "ldap://") {
+        addr = strings.TrimPrefix(addr, "ldap://")
+        if mode == "ldaps" {
+            return "", "", fmt.Errorf("ldap:// server path conflicts with ldap_tls ldaps")
+        }
+    }
+    addr = strings.TrimSuffix(addr, "/")
+
+    if mode == "" {
+        mode = "none"
+    }
+
+    if _, _, err := net.SplitHostPort(addr); err != nil {
+        // Fill in the standard port for the selected mode.
+        if mode == "ldaps" {
+            addr = net.JoinHostPort(addr, "636")
+        } else {
+            addr = net.JoinHostPort(addr, "389")
+        }
+    }
+
+    switch mode {
+        case "none", "ldaps", "starttls":
+            return addr, mode, nil
+        default:
+            return "", "", fmt.Errorf("Unknown ldap_tls mode (%s)", mode)
+    }
+}
+
+func ldapTLSConfig(c *SSHConfig, addr string) (*tls.Config, error) {
+    tlsConfig := &tls.Config{
+        MinVersion:     tls.VersionTLS12,
+    }
+
+    // Verify the certificate against the configured name, or the host we dialled.
+    if len(c.Global.LDAP_ServerName) > 0 {
+        tlsConfig.ServerName = c.Global.LDAP_ServerName
+    } else {
+        host, _, err := net.SplitHostPort(addr)
+        if err != nil {
+            return nil, err
+        }
+        tlsConfig.ServerName = host
+    }
+
+    if len(c.Global.LDAP_CAFile) > 0 {
+        caData, err := ioutil.ReadFile(c.Global.LDAP_CAFile)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to read LDAP CA file (%s): %s", c.Global.LDAP_CAFile, err)
+        }
+
+        pool := x509.NewCertPool()
+        if ! pool.AppendCertsFromPEM(caData) {
+            return nil, fmt.Errorf("No certificates found in LDAP CA file (%s)", c.Global.LDAP_CAFile)
+        }
+        tlsConfig.RootCAs = pool
+    }
+
+    if len(c.Global.LDAP_ClientCert) > 0 || len(c.Global.LDAP_ClientKey) > 0 {
+        cert, err := tls.LoadX509KeyPair(c.Global.LDAP_ClientCert, c.Global.LDAP_ClientKey)
+        if err != nil {
+            return nil, fmt.Errorf("Unable to load LDAP client certificate (%s): %s", c.Global.LDAP_ClientCert, err)
+        }
+        tlsConfig.Certificates = []tls.Certificate{ cert }
+    }
+
+    return tlsConfig, nil
+}
+
+// Connects to the configured LDAP server, negotiating TLS as configured.
+func dialLDAP(c *SSHConfig) (*ldap.Conn, error) {
+    addr, mode, err := ldapServerAddr(c)
+    if err != nil {
+        return nil, err
+    }
+
+    if mode == "none" {
+        l, lerr := ldap.Dial("tcp", addr)
+        if lerr != nil {
+            return nil, fmt.Errorf("%s", lerr)
+        }
+        return l, nil
+    }
+
+    tlsConfig, err := ldapTLSConfig(c, addr)
+    if err != nil {
+        return nil, err
+    }
+
+    var l *ldap.Conn
+    var lerr *ldap.Error
+    if mode == "ldaps" {
+        l, lerr = ldap.DialSSL("tcp", addr, tlsConfig)
+    } else {
+        l, lerr = ldap.DialTLS("tcp", addr, tlsConfig)
+    }
+    if lerr != nil {
+        return nil, fmt.Errorf("%s (%s)", lerr, mode)
+    }
+
+    return l, nil
+}
+
+// Escapes a value for inclusion in an LDAP search filter (RFC 4515).
+func ldapEscapeFilter(s string) string {
+    var b strings.Builder
+    for i := 0; i < len(s); i++ {
+        switch s[i] {
+            case '*', '(', ')', '\\', 0:
+                fmt.Fprintf(&b, "\\%02x", s[i])
+            default:
+                b.WriteByte(s[i])
+        }
+    }
+    return b.String()
+}
+
+// Looks up the directory entry for a user with the configured base DN and filter.
+func ldapSearchUser(c *SSHConfig, l *ldap.Conn, username string, attributes []string, defaultFilter string) (*ldap.Entry, error) {
+    filter := c.Global.LDAP_UserFilter
+    if len(filter) == 0 {
+        filter = defaultFilter
+    }
+    filter = strings.Replace(filter, "%s", ldapEscapeFilter(username), -1)
+
+    req := ldap.NewSearchRequest(c.Global.LDAP_BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false, filter, attributes, nil)
+    res, lerr := l.Search(req)
+    if lerr != nil {
+        return nil, fmt.Errorf("%s", lerr)
+    }
+
+    if len(res.Entries) != 1 {
+        return nil, fmt.Errorf("Expected 1 entry for user (%s), found %d", username, len(res.Entries))
+    }
+
+    return res.Entries[0], nil
+}
+
+// Returns the first RDN value of a DN, i.e. the CN of a group.
+func ldapRDNValue(dn string) string {
+    rdn := strings.SplitN(dn, ",", 2)[0]
+    if i := strings.Index(rdn, "="); i >= 0 {
+        return strings.TrimSpace(rdn[i+1:])
+    }
+    return strings.TrimSpace(rdn)
+}
+
+// Maps a user's groups to ACL names through the group_acls config section.
+// Groups are matched by full DN, case insensitively, or also by CN alone if
+// group_acls_match_cn is set, in which case a group of the same name in any
+// part of the directory matches.
+func groupACLs(c *SSHConfig, groups []string) []string {
+    var acls []string
+    for _, group := range groups {
+        for name, acl := range c.GroupACLs {
+            if strings.EqualFold(name, group) || ( c.Global.GroupACLsMatchCN && strings.EqualFold(name, ldapRDNValue(group)) ) {
+                acls = appendUnique(acls, acl)
+            }
+        }
+    }
+    sort.Strings(acls)
+    return acls
+}
+
+func init() {
+    RegisterAuthenticator("ad", AuthenticatorFunc(authAD))
+    RegisterAuthenticator("ldap", AuthenticatorFunc(authLDAP))
+}
+
+// Resolves the ACLs for a user's groups through group_acls.
+func groupExtensions(c *SSHConfig, groups []string) map[string]string {
+    if acls := groupACLs(c, groups); len(acls) > 0 {
+        return map[string]string{ "acls": strings.Join(acls, ",") }
+    }
+    return nil
+}
+
+// Authenticates with an Active Directory UPN bind (user@ldap_domain),
+// resolving the user's groups if group_acls are in use.
+func authAD(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    username := conn.User()
+
+    l, err := dialLDAP(c)
+    if err != nil {
+        log.Printf("LDAP Connect Failed: %s", err)
+        return nil, fmt.Errorf("LDAP Connect Failed: %s", err)
+    }
+    defer l.Close()
+
+    if err := l.Bind(fmt.Sprintf("%s@%s", username, c.Global.LDAP_Domain), string(password)); err != nil {
+        log.Printf("LDAP Bind Failed: %s", err)
+        return nil, fmt.Errorf("LDAP Bind Failed: %s", err)
+    }
+
+    if len(c.GroupACLs) == 0 {
+        return nil, nil
+    }
+
+    entry, err := ldapSearchUser(c, l, username, []string{"memberOf"}, "(&(objectClass=user)(sAMAccountName=%s))")
+    if err != nil {
+        log.Printf("LDAP Group Search Failed for user (%s): %s", username, err)
+        return nil, nil
+    }
+
+    return groupExtensions(c, entry.GetAttributeValues("memberOf")), nil
+}
+
+// Authenticates by binding with the service account, searching for the user
+// and then binding as the DN that was found, as is usual for OpenLDAP or FreeIPA.
+func authLDAP(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    username := conn.User()
+
+    l, err := dialLDAP(c)
+    if err != nil {
+        log.Printf("LDAP Connect Failed: %s", err)
+        return nil, fmt.Errorf("LDAP Connect Failed: %s", err)
+    }
+    defer l.Close()
+
+    if err := l.Bind(c.Global.LDAP_BindDN, c.Global.LDAP_BindPassword); err != nil {
+        log.Printf("LDAP Service Bind Failed (%s): %s", c.Global.LDAP_BindDN, err)
+        return nil, fmt.Errorf("LDAP Service Bind Failed: %s", err)
+    }
+
+    entry, err := ldapSearchUser(c, l, username, []string{"memberOf"}, "(uid=%s)")
+    if err != nil {
+        log.Printf("LDAP User Search Failed: %s", err)
+        return nil, fmt.Errorf("LDAP User Search Failed: %s", err)
+    }
+
+    if err := l.Bind(entry.DN, string(password)); err != nil {
+        log.Printf("LDAP Bind Failed (%s): %s", entry.DN, err)
+        return nil, fmt.Errorf("LDAP Bind Failed: %s", err)
+    }
+
+    return groupExtensions(c, entry.GetAttributeValues("memberOf")), nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+    "io"
+    "net"
+    "time"
+    "bufio"
+    "testing"
+    "math/big"
+    "io/ioutil"
+    "crypto/tls"
+    "crypto/rand"
+    "crypto/x509"
+    "crypto/ecdsa"
+    "crypto/elliptic"
+    "encoding/pem"
+    "path/filepath"
+    "crypto/x509/pkix"
+)
+
+func TestLDAPServerAddr(t *testing.T) {
+    for _, test := range []struct {
+        server      string
+        tls         string
+        addr        string
+        mode        string
+    }{
+        { "ad.domain.local", "", "ad.domain.local:389", "none" },
+        { "ad.domain.local:3268", "", "ad.domain.local:3268", "none" },
+        { "ad.domain.local", "StartTLS", "ad.domain.local:389", "starttls" },
+        { "ad.domain.local", "ldaps", "ad.domain.local:636", "ldaps" },
+        { "ldaps://ad.domain.local/", "", "ad.domain.local:636", "ldaps" },
+        { "ldaps://ad.domain.local:3269", "starttls", "ad.domain.local:3269", "ldaps" },
+        { "ldap://ad.domain.local", "starttls", "ad.domain.local:389", "starttls" },
+        { "[2001:db8::1]:389", "", "[2001:db8::1]:389", "none" },
+    } {
+        c := &SSHConfig{}
+        c.Global.LDAP_Server, c.Global.LDAP_TLS = test.server, test.tls
+        addr, mode, err := ldapServerAddr(c)
+        if err != nil || addr != test.addr || mode != test.mode {
+            t.Errorf("%s (%s): expected %s %s, got %s %s %v", test.server, test.tls, test.addr, test.mode, addr, mode, err)
+        }
+    }
+
+    for server, mode := range map[string]string{ "ldap://ad.domain.local": "ldaps", "ad.domain.local": "tls" } {
+        c := &SSHConfig{}
+        c.Global.LDAP_Server, c.Global.LDAP_TLS = server, mode
+        if _, _, err := ldapServerAddr(c); err == nil {
+            t.Errorf("%s (%s): expected an error", server, mode)
+        }
+    }
+}
+
+// A CA and a certificate it issued for ldap.test and 127.0.0.1.
+type testLDAPCerts struct {
+    caFile      string
+    server      tls.Certificate
+}
+
+func newTestLDAPCerts(t *testing.T, dir string) *testLDAPCerts {
+    caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    caTemplate := &x509.Certificate{
+        SerialNumber:           big.NewInt(1),
+        Subject:                pkix.Name{ CommonName: "Test LDAP CA" },
+        NotBefore:              time.Now().Add(-time.Hour),
+        NotAfter:               time.Now().Add(time.Hour),
+        IsCA:                   true,
+        BasicConstraintsValid:  true,
+        KeyUsage:               x509.KeyUsageCertSign,
+    }
+    caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    caCert, err := x509.ParseCertificate(caDER)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        t.Fatal(err)
+    }
+    template := &x509.Certificate{
+        SerialNumber:   big.NewInt(2),
+        Subject:        pkix.Name{ CommonName: "ldap.test" },
+        DNSNames:       []string{ "ldap.test" },
+        IPAddresses:    []net.IP{ net.ParseIP("127.0.0.1") },
+        NotBefore:      time.Now().Add(-time.Hour),
+        NotAfter:       time.Now().Add(time.Hour),
+        KeyUsage:       x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:    []x509.ExtKeyUsage{ x509.ExtKeyUsageServerAuth },
+    }
+    der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    caFile, err := ioutil.TempFile(dir, "ca")
+    if err != nil {
+        t.Fatal(err)
+    }
+    pem.Encode(caFile, &pem.Block{ Type: "CERTIFICATE", Bytes: caDER })
+    caFile.Close()
+
+    return &testLDAPCerts{
+        caFile: caFile.Name(),
+        server: tls.Certificate{ Certificate: [][]byte{ der }, PrivateKey: key },
+    }
+}
+
+// Reads one BER element, returning its tag and contents.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+    tag, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+    length, err := r.ReadByte()
+    if err != nil {
+        return 0, nil, err
+    }
+    n := int(length)
+    if length & 0x80 != 0 {
+        n = 0
+        for i := 0; i < int(length & 0x7f); i++ {
+            b, err := r.ReadByte()
+            if err != nil {
+                return 0, nil, err
+            }
+            n = n << 8 | int(b)
+        }
+    }
+    contents := make([]byte, n)
+    _, err = io.ReadFull(r, contents)
+    return tag, contents, err
+}
+
+// Answers StartTLS and bind requests like an LDAP server, with TLS from the
+// start in ldaps mode or after the StartTLS extended request otherwise.
+func serveTestLDAP(conn net.Conn, config *tls.Config, ldaps bool) {
+    defer func() { conn.Close() }()
+    if ldaps {
+        conn = tls.Server(conn, config)
+    }
+
+    r := bufio.NewReader(conn)
+    for {
+        tag, message, err := readBER(r)
+        if err != nil || tag != 0x30 || len(message) < 3 || message[0] != 0x02 {
+            return
+        }
+        id := message[2:2+int(message[1])]
+        op := message[2+int(message[1])]
+
+        // LDAPResult of success, with an empty matched DN and message.
+        result := []byte{ 0x0a, 0x01, 0x00, 0x04, 0x00, 0x04, 0x00 }
+        reply := func(op byte) {
+            body := append(append([]byte{ 0x02, byte(len(id)) }, id...), op, byte(len(result)))
+            body = append(body, result...)
+            conn.Write(append([]byte{ 0x30, byte(len(body)) }, body...))
+        }
+
+        switch op {
+            case 0x77:
+                // StartTLS extended request.
+                reply(0x78)
+                conn = tls.Server(conn, config)
+                r = bufio.NewReader(conn)
+            case 0x60:
+                reply(0x61)
+            default:
+                return
+        }
+    }
+}
+
+func newTestLDAPServer(t *testing.T, certs *testLDAPCerts, ldaps bool) string {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { l.Close() })
+
+    config := &tls.Config{ Certificates: []tls.Certificate{ certs.server } }
+    go func() {
+        for {
+            conn, err := l.Accept()
+            if err != nil {
+                return
+            }
+            go serveTestLDAP(conn, config, ldaps)
+        }
+    }()
+    return l.Addr().String()
+}
+
+func TestLDAPTLSConfig(t *testing.T) {
+    dir := t.TempDir()
+    certs := newTestLDAPCerts(t, dir)
+
+    c := &SSHConfig{}
+    c.Global.LDAP_CAFile = certs.caFile
+    config, err := ldapTLSConfig(c, "ad.domain.local:636")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if config.ServerName != "ad.domain.local" || config.RootCAs == nil || config.MinVersion != tls.VersionTLS12 {
+        t.Errorf("Unexpected TLS config %+v", config)
+    }
+
+    c.Global.LDAP_ServerName = "dc1.domain.local"
+    if config, err := ldapTLSConfig(c, "10.0.0.1:636"); err != nil || config.ServerName != "dc1.domain.local" {
+        t.Errorf("Expected ldap_server_name to be verified, got %v", err)
+    }
+
+    notPEM := filepath.Join(dir, "not-pem")
+    ioutil.WriteFile(notPEM, []byte("not a certificate"), 0600)
+    for _, caFile := range []string{ filepath.Join(dir, "missing"), notPEM } {
+        c.Global.LDAP_CAFile = caFile
+        if _, err := ldapTLSConfig(c, "ad.domain.local:636"); err == nil {
+            t.Errorf("%s: expected an error", caFile)
+        }
+    }
+
+    c.Global.LDAP_CAFile = certs.caFile
+    c.Global.LDAP_ClientCert = filepath.Join(dir, "missing")
+    if _, err := ldapTLSConfig(c, "ad.domain.local:636"); err == nil {
+        t.Errorf("Expected an unreadable client certificate to fail")
+    }
+}
+
+// Dials the stand-in server and binds, TLS failures may show at either step.
+func testLDAPBind(c *SSHConfig) error {
+    l, err := dialLDAP(c)
+    if err != nil {
+        return err
+    }
+    defer l.Close()
+
+    if lerr := l.Bind("cn=bastion,dc=test", "secret"); lerr != nil {
+        return lerr
+    }
+    return nil
+}
+
+func TestDialLDAP(t *testing.T) {
+    dir := t.TempDir()
+    certs := newTestLDAPCerts(t, dir)
+    otherCA := newTestLDAPCerts(t, dir).caFile
+
+    for _, mode := range []string{ "ldaps", "starttls" } {
+        addr := newTestLDAPServer(t, certs, mode == "ldaps")
+
+        for _, test := range []struct {
+            name        string
+            caFile      string
+            serverName  string
+            ok          bool
+        }{
+            { "trusted CA", certs.caFile, "", true },
+            { "server name", certs.caFile, "ldap.test", true },
+            { "untrusted CA", otherCA, "", false },
+            { "no CA file", "", "", false },
+            { "wrong server name", certs.caFile, "other.test", false },
+        } {
+            c := &SSHConfig{}
+            c.Global.LDAP_Server = addr
+            c.Global.LDAP_TLS = mode
+            c.Global.LDAP_CAFile = test.caFile
+            c.Global.LDAP_ServerName = test.serverName
+
+            if err := testLDAPBind(c); ( err == nil ) != test.ok {
+                t.Errorf("%s %s: unexpected result %v", mode, test.name, err)
+            }
+        }
+    }
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "bufio"
+    "bytes"
+    "strings"
+    "io/ioutil"
+    "crypto/rand"
+    "crypto/subtle"
+    "encoding/base64"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/bcrypt"
+    "golang.org/x/crypto/ssh"
+    "golang.org/x/crypto/ssh/terminal"
+)
+
+// Argon2id parameters for new hashes (RFC 9106 recommended, 64MiB memory).
+const (
+    argon2Time      = 3
+    argon2Memory    = 64 * 1024
+    argon2Threads   = 4
+    argon2KeyLen    = 32
+    argon2SaltLen   = 16
+)
+
+// Limits on the parameters of argon2id hashes that are accepted, as argon2
+// panics on some out of range values and a huge memory cost would let anyone
+// trying the user's password exhaust the server's memory.
+const (
+    argon2MaxTime       = 64
+    argon2MaxMemory     = 1024 * 1024
+    argon2MinKeyLen     = 16
+    argon2MaxKeyLen     = 1024
+    argon2MinSaltLen    = 8
+)
+
+// Password hashes from the local password file, re-read when the file changes.
+type localPasswordDB struct {
+    hashes      map[string]string
+    filename    string
+    modTime     time.Time
+    size        int64
+    mutex       *sync.Mutex
+}
+
+var localPasswords = &localPasswordDB{ mutex: &sync.Mutex{} }
+
+// Parses "user:hash" lines, ignoring blank lines and # comments.
+func parseLocalPasswordFile(data []byte) (map[string]string, error) {
+    hashes := map[string]string{}
+
+    scanner := bufio.NewScanner(bytes.NewReader(data))
+    for line := 1; scanner.Scan(); line++ {
+        text := strings.TrimSpace(scanner.Text())
+        if len(text) == 0 || strings.HasPrefix(text, "#") {
+            continue
+        }
+
+        parts := strings.SplitN(text, ":", 2)
+        if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+            return nil, fmt.Errorf("Invalid entry on line %d", line)
+        }
+        if err := checkPasswordHash(parts[1]); err != nil {
+            return nil, fmt.Errorf("Invalid entry on line %d: %s", line, err)
+        }
+        hashes[parts[0]] = parts[1]
+    }
+
+    return hashes, scanner.Err()
+}
+
+func (db *localPasswordDB) lookup(filename string, username string) (string, error) {
+    db.mutex.Lock()
+    defer db.mutex.Unlock()
+
+    if len(filename) == 0 {
+        return "", fmt.Errorf("No local_password_file configured")
+    }
+
+    info, err := os.Stat(filename)
+    if err != nil {
+        return "", fmt.Errorf("Unable to read local password file (%s): %s", filename, err)
+    }
+
+    if db.hashes == nil || db.filename != filename || ! info.ModTime().Equal(db.modTime) || info.Size() != db.size {
+        data, err := ioutil.ReadFile(filename)
+        if err != nil {
+            return "", fmt.Errorf("Unable to read local password file (%s): %s", filename, err)
+        }
+
+        hashes, err := parseLocalPasswordFile(data)
+        if err != nil {
+            return "", fmt.Errorf("Unable to parse local password file (%s): %s", filename, err)
+        }
+
+        if db.hashes != nil {
+            log.Printf("Reloaded local password file (%s)", filename)
+        }
+        db.hashes = hashes
+        db.filename = filename
+        db.modTime = info.ModTime()
+        db.size = info.Size()
+    }
+
+    hash, ok := db.hashes[username]
+    if ! ok {
+        return "", fmt.Errorf("User not found in local password file")
+    }
+    return hash, nil
+}
+
+func hashArgon2id(password []byte) (string, error) {
+    salt := make([]byte, argon2SaltLen)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+
+    key := argon2.IDKey(password, salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+        base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+type argon2idHash struct {
+    memory      uint32
+    iterations  uint32
+    threads     uint8
+    salt        []byte
+    key         []byte
+}
+
+// Parses an argon2id hash in the PHC string format, rejecting parameters
+// outside of the limits above.
+func parseArgon2id(hash string) (*argon2idHash, error) {
+    parts := strings.Split(hash, "$")
+    if len(parts) != 6 || parts[1] != "argon2id" {
+        return nil, fmt.Errorf("Invalid argon2id hash")
+    }
+
+    var version int
+    if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+        return nil, fmt.Errorf("Unsupported argon2id version (%s)", parts[2])
+    }
+
+    h := &argon2idHash{}
+    if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.iterations, &h.threads); err != nil {
+        return nil, fmt.Errorf("Invalid argon2id parameters (%s)", parts[3])
+    }
+    if h.iterations < 1 || h.iterations > argon2MaxTime {
+        return nil, fmt.Errorf("Invalid argon2id time cost (%d), expected 1-%d", h.iterations, argon2MaxTime)
+    }
+    if h.threads < 1 {
+        return nil, fmt.Errorf("Invalid argon2id parallelism (%d)", h.threads)
+    }
+    if h.memory < 8 * uint32(h.threads) || h.memory > argon2MaxMemory {
+        return nil, fmt.Errorf("Invalid argon2id memory cost (%d), expected %d-%d KiB", h.memory, 8 * uint32(h.threads), argon2MaxMemory)
+    }
+
+    var err error
+    if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+        return nil, fmt.Errorf("Invalid argon2id salt: %s", err)
+    }
+    if len(h.salt) < argon2MinSaltLen {
+        return nil, fmt.Errorf("Invalid argon2id salt, shorter than %d bytes", argon2MinSaltLen)
+    }
+    if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+        return nil, fmt.Errorf("Invalid argon2id hash: %s", err)
+    }
+    if len(h.key) < argon2MinKeyLen || len(h.key) > argon2MaxKeyLen {
+        return nil, fmt.Errorf("Invalid argon2id hash length (%d), expected %d-%d bytes", len(h.key), argon2MinKeyLen, argon2MaxKeyLen)
+    }
+
+    return h, nil
+}
+
+// Verifies a password against an argon2id hash in the PHC string format.
+// Hashes that don't parse never match.
+func verifyArgon2id(hash string, password []byte) (bool, error) {
+    h, err := parseArgon2id(hash)
+    if err != nil {
+        return false, err
+    }
+
+    computed := argon2.IDKey(password, h.salt, h.iterations, h.memory, h.threads, uint32(len(h.key)))
+    return subtle.ConstantTimeCompare(computed, h.key) == 1, nil
+}
+
+// Checks that a hash from the local password file can be verified, so a
+// malformed entry is rejected when the file is loaded.
+func checkPasswordHash(hash string) error {
+    switch {
+        case strings.HasPrefix(hash, "$argon2id$"):
+            _, err := parseArgon2id(hash)
+            return err
+        case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+            _, err := bcrypt.Cost([]byte(hash))
+            return err
+        default:
+            return fmt.Errorf("Unsupported password hash type")
+    }
+}
+
+func verifyPasswordHash(hash string, password []byte) (bool, error) {
+    switch {
+        case strings.HasPrefix(hash, "$argon2id$"):
+            return verifyArgon2id(hash, password)
+        case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+            err := bcrypt.CompareHashAndPassword([]byte(hash), password)
+            if err == bcrypt.ErrMismatchedHashAndPassword {
+                return false, nil
+            }
+            return err == nil, err
+        default:
+            return false, fmt.Errorf("Unsupported password hash type")
+    }
+}
+
+func init() {
+    RegisterAuthenticator("local", AuthenticatorFunc(authLocal))
+}
+
+// Authenticates against the local password file (bcrypt or argon2id hashes).
+func authLocal(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    username := conn.User()
+    hash, err := localPasswords.lookup(c.Global.LocalPasswordFile, username)
+    if err != nil {
+        log.Printf("Local Auth Failed for user (%s): %s", username, err)
+        return nil, fmt.Errorf("Local Auth Failed: %s", err)
+    }
+
+    ok, err := verifyPasswordHash(hash, password)
+    if err != nil {
+        log.Printf("Local Auth Failed for user (%s): %s", username, err)
+        return nil, fmt.Errorf("Local Auth Failed: %s", err)
+    }
+    if ! ok {
+        return nil, fmt.Errorf("Local Auth Failed: Invalid Password")
+    }
+
+    return nil, nil
+}
+
+type hashPasswordCommand struct {
+    User        string      `short:"u" long:"user" description:"Username for the entry" required:"true"`
+    Bcrypt      bool        `long:"bcrypt" description:"Use bcrypt instead of argon2id"`
+    Write       bool        `short:"w" long:"write" description:"Add or replace the entry in the local_password_file"`
+}
+
+func readPassword(prompt string) ([]byte, error) {
+    fd := int(os.Stdin.Fd())
+    if ! terminal.IsTerminal(fd) {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && len(line) == 0 {
+            return nil, err
+        }
+        return []byte(strings.TrimRight(line, "\r\n")), nil
+    }
+
+    fmt.Fprint(os.Stderr, prompt)
+    password, err := terminal.ReadPassword(fd)
+    fmt.Fprintln(os.Stderr)
+    return password, err
+}
+
+// Hashes a password read from the terminal (or stdin) into a local password
+// file entry, printing it or writing it to the configured file.
+func (c *hashPasswordCommand) Execute(args []string) error {
+    if err := loadConfig(); err != nil {
+        return err
+    }
+
+    if strings.Contains(c.User, ":") {
+        return fmt.Errorf("Username can't contain \":\"")
+    }
+
+    password, err := readPassword("Password: ")
+    if err != nil {
+        return err
+    }
+    if len(password) == 0 {
+        return fmt.Errorf("Blank Password Not Allowed")
+    }
+
+    if terminal.IsTerminal(int(os.Stdin.Fd())) {
+        confirm, err := readPassword("Confirm Password: ")
+        if err != nil {
+            return err
+        }
+        if subtle.ConstantTimeCompare(password, confirm) != 1 {
+            return fmt.Errorf("Passwords do not match")
+        }
+    }
+
+    var hash string
+    if c.Bcrypt {
+        hashBytes, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+        if err != nil {
+            return err
+        }
+        hash = string(hashBytes)
+    } else {
+        hash, err = hashArgon2id(password)
+        if err != nil {
+            return err
+        }
+    }
+
+    entry := fmt.Sprintf("%s:%s", c.User, hash)
+    if ! c.Write {
+        fmt.Println(entry)
+        return nil
+    }
+
+    filename := getConfig().Global.LocalPasswordFile
+    if len(filename) == 0 {
+        return fmt.Errorf("No local_password_file configured")
+    }
+
+    data, err := ioutil.ReadFile(filename)
+    if err != nil && ! os.IsNotExist(err) {
+        return fmt.Errorf("Unable to read local password file (%s): %s", filename, err)
+    }
+
+    // Replace any existing entry for the user, keeping everything else as is.
+    var lines []string
+    replaced := false
+    for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+        if strings.HasPrefix(strings.TrimSpace(line), c.User + ":") {
+            line = entry
+            replaced = true
+        }
+        if len(line) > 0 || len(lines) > 0 {
+            lines = append(lines, line)
+        }
+    }
+    if ! replaced {
+        lines = append(lines, entry)
+    }
+
+    if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n") + "\n"), 0600); err != nil {
+        return fmt.Errorf("Unable to write local password file (%s): %s", filename, err)
+    }
+    fmt.Printf("Entry for %s written to %s\n", c.User, filename)
+
+    return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestVerifyArgon2id(t *testing.T) {
+    hash, err := hashArgon2id([]byte("secret"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if ok, err := verifyArgon2id(hash, []byte("secret")); err != nil || ! ok {
+        t.Errorf("Expected the password to match, got %v, %v", ok, err)
+    }
+    if ok, err := verifyArgon2id(hash, []byte("wrong")); err != nil || ok {
+        t.Errorf("Expected the wrong password not to match, got %v, %v", ok, err)
+    }
+}
+
+// Each of these made argon2.IDKey panic before the parameters were checked.
+var malformedArgon2idHashes = map[string]string{
+    "empty key":        "$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHRzb21lc2FsdA$",
+    "short key":        "$argon2id$v=19$m=65536,t=3,p=4$c29tZXNhbHRzb21lc2FsdA$c2hvcnQ",
+    "zero parallelism": "$argon2id$v=19$m=65536,t=3,p=0$c29tZXNhbHRzb21lc2FsdA$YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE",
+    "zero time":        "$argon2id$v=19$m=65536,t=0,p=4$c29tZXNhbHRzb21lc2FsdA$YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE",
+    "huge memory":      "$argon2id$v=19$m=4294967295,t=3,p=4$c29tZXNhbHRzb21lc2FsdA$YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE",
+    "short salt":       "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$YWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWFhYWE",
+}
+
+func TestVerifyArgon2idMalformed(t *testing.T) {
+    for name, hash := range malformedArgon2idHashes {
+        if ok, err := verifyArgon2id(hash, []byte("secret")); err == nil || ok {
+            t.Errorf("%s: expected an error, got %v, %v", name, ok, err)
+        }
+    }
+}
+
+func TestParseLocalPasswordFile(t *testing.T) {
+    hash, err := hashArgon2id([]byte("secret"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    hashes, err := parseLocalPasswordFile([]byte("# comment\n\nalice:" + hash + "\n"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if hashes["alice"] != hash {
+        t.Errorf("Expected alice's hash, got %q", hashes["alice"])
+    }
+
+    for name, bad := range malformedArgon2idHashes {
+        _, err := parseLocalPasswordFile([]byte("alice:" + hash + "\nbob:" + bad + "\n"))
+        if err == nil || ! strings.Contains(err.Error(), "line 2") {
+            t.Errorf("%s: expected an error on line 2, got %v", name, err)
+        }
+    }
+
+    if _, err := parseLocalPasswordFile([]byte("bob:$2a$10$tooshort\n")); err == nil {
+        t.Errorf("Expected an error for a malformed bcrypt hash")
+    }
+}
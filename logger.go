@@ -8,6 +8,7 @@ import (
     "sync"
     "bytes"
     "syscall"
+    "strings"
     "encoding/binary"
     "golang.org/x/crypto/ssh"
 )
@@ -47,15 +48,17 @@ func NewLogChannel(startTime time.Time, channel ssh.Channel, username string) *L
     }
 }
 
-func (l *LogChannel) SyncToFile(remote_name string) (error) {
+func (l *LogChannel) SyncToFile(log_path string, remote_name string, login_user string) (error) {
     var err error
 
-    filepath := fmt.Sprintf("%s/%d/%d", config.Global.LogPath, l.StartTime.Year(), l.StartTime.Month())
+    filepath := fmt.Sprintf("%s/%d/%d", log_path, l.StartTime.Year(), l.StartTime.Month())
     err = os.MkdirAll(filepath, 0750)
     if err != nil {
         return fmt.Errorf("Unable to create required log directory (%s): %s", filepath, err)
     }
-    filename := filepath + "/" + fmt.Sprintf("ssh_log_%s_%s_%s", l.StartTime.Format(time.RFC3339), l.UserName, remote_name)
+    // The login user may come from a template, so keep it from adding directories.
+    login_user = strings.Replace(login_user, "/", "_", -1)
+    filename := filepath + "/" + fmt.Sprintf("ssh_log_%s_%s_%s@%s", l.StartTime.Format(time.RFC3339), l.UserName, login_user, remote_name)
 
     l.logMutex.Lock()
 
@@ -0,0 +1,85 @@
+package main
+
+import (
+    "fmt"
+    "bytes"
+    "strings"
+    "text/template"
+    "golang.org/x/crypto/ssh"
+)
+
+// Values available to login_user, user_map and login_users templates,
+// e.g. "{{.User}}-adm".
+type loginUserTemplateData struct {
+    User        string
+    Server      string
+}
+
+func parseLoginUserTemplate(value string) (*template.Template, error) {
+    return template.New("login_user").Option("missingkey=error").Parse(value)
+}
+
+// Expands a remote account template for the bastion user and server. A plain
+// account name is returned as it is.
+func expandLoginUser(value string, username string, server string) (string, error) {
+    tmpl, err := parseLoginUserTemplate(value)
+    if err != nil {
+        return "", fmt.Errorf("Invalid login user template (%s): %s", value, err)
+    }
+
+    var b bytes.Buffer
+    if err := tmpl.Execute(&b, loginUserTemplateData{ User: username, Server: server }); err != nil {
+        return "", fmt.Errorf("Invalid login user template (%s): %s", value, err)
+    }
+
+    loginUser := strings.TrimSpace(b.String())
+    if len(loginUser) == 0 {
+        return "", fmt.Errorf("Login user template (%s) expanded to an empty user", value)
+    }
+    return loginUser, nil
+}
+
+// Returns the remote account a user logs in to a server as by default, from
+// the login_user set at auth time (e.g. by the webhook), the server's user_map,
+// the server's login_user template, or otherwise the bastion username.
+func defaultLoginUser(c *SSHConfig, username string, perm *ssh.Permissions, server string) (string, error) {
+    if perm != nil && len(perm.Extensions["login_user"]) > 0 {
+        return perm.Extensions["login_user"], nil
+    }
+
+    remote := c.Servers[server]
+    if mapped, ok := remote.UserMap[username]; ok {
+        return expandLoginUser(mapped, username, server)
+    }
+    if len(remote.LoginUser) > 0 {
+        return expandLoginUser(remote.LoginUser, username, server)
+    }
+    return username, nil
+}
+
+// Returns the remote accounts a connection may log in to a server as, the
+// default first, followed by those the login_users of its usable ACLs
+// allowing the server add.
+func allowedLoginUsers(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions, server string) ([]string, error) {
+    loginUser, err := defaultLoginUser(c, conn.User(), perm, server)
+    if err != nil {
+        return nil, err
+    }
+    logins := []string{ loginUser }
+
+    for _, name := range userACLs(c, conn, perm) {
+        acl, ok := c.ACLs[name]
+        if ! ok || ! containsString(aclServers(c, acl), server) {
+            continue
+        }
+        for _, value := range acl.LoginUsers {
+            login, err := expandLoginUser(value, conn.User(), server)
+            if err != nil {
+                return nil, err
+            }
+            logins = appendUnique(logins, login)
+        }
+    }
+
+    return logins, nil
+}
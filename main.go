@@ -5,12 +5,13 @@ import (
     "fmt"
     "log"
     "strings"
+    "syscall"
+    "os/signal"
     "io/ioutil"
     "log/syslog"
     "github.com/jessevdk/go-flags"
 )
 
-var config *SSHConfig
 var authLogger *syslog.Writer
 
 var opts struct {
@@ -18,38 +19,77 @@ var opts struct {
 }
 
 func main() {
-    _, err := flags.Parse(&opts)
+    parser := flags.NewParser(&opts, flags.Default)
+    parser.SubcommandsOptional = true
+    parser.AddCommand("totp-enroll", "Enroll a user for TOTP", "Generate a TOTP secret for a user and print the provisioning URI.", &totpEnrollCommand{})
+    parser.AddCommand("hash-password", "Create a local password entry", "Hash a password (argon2id or bcrypt) for the local_password_file.", &hashPasswordCommand{})
+    parser.AddCommand("check-config", "Validate the config file", "Check the config file for unknown keys, dangling ACL and server references and unreadable key files.", &checkConfigCommand{})
+
+    _, err := parser.Parse()
     if err != nil {
         os.Exit(1)
     }
 
-    if _, err := os.Stat(opts.Config); err != nil {
-        log.Fatalf("Specified config file doesn't exist!\n")
+    // Subcommands are run by the parser, there is nothing left to do.
+    if parser.Active != nil {
+        return
     }
 
-    config, err = fetchConfig(opts.Config)
+    // Catch SIGHUP before anything else, its default action is to exit. A
+    // signal received while starting up reloads the config once running.
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+
+    c, problems, err := checkConfigFile(opts.Config)
     if err != nil {
         panic(err)
     }
+    for _, problem := range problems {
+        log.Printf("Config problem: %s", problem)
+    }
+    if len(problems) > 0 {
+        log.Fatalf("Refusing to start with %d config problem(s), see check-config.", len(problems))
+    }
+    setConfig(c)
 
     authLogger, err = syslog.New(syslog.LOG_AUTH | syslog.LOG_ALERT, "ssh-bastion")
     if err != nil {
         panic(err)
     }
 
+    authLimiter, err = NewAuthLimiter()
+    if err != nil {
+        panic(err)
+    }
+
     s, err := NewSSHServer()
     if err != nil {
         panic(err)
     }
 
-    s.ListenAndServe(config.Global.ListenPath)
+    go watchConfig(hup)
+
+    s.ListenAndServe(getConfig().Global.ListenPath)
+}
+
+func loadConfig() (error) {
+    if _, err := os.Stat(opts.Config); err != nil {
+        log.Fatalf("Specified config file doesn't exist!\n")
+    }
+
+    c, err := fetchConfig(opts.Config)
+    if err != nil {
+        return err
+    }
+    setConfig(c)
+    return nil
 }
 
-func GetMOTD() (string) {
-    if len(config.Global.MOTDPath) > 0 {
-        str, err := ioutil.ReadFile(config.Global.MOTDPath)
+func GetMOTD(c *SSHConfig) (string) {
+    if len(c.Global.MOTDPath) > 0 {
+        str, err := ioutil.ReadFile(c.Global.MOTDPath)
         if err != nil {
-            log.Printf("Error reading MOTD file (%s): %s", config.Global.MOTDPath, err)
+            log.Printf("Error reading MOTD file (%s): %s", c.Global.MOTDPath, err)
             return ""
         } else {
             return strings.Replace(string(str), "\n", "\r\n", -1)
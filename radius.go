@@ -0,0 +1,414 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "net"
+    "time"
+    "bytes"
+    "crypto/md5"
+    "crypto/hmac"
+    "crypto/rand"
+    "encoding/binary"
+    "golang.org/x/crypto/ssh"
+)
+
+// RADIUS packet codes and attribute types (RFC 2865, RFC 3579).
+const (
+    radiusAccessRequest         = 1
+    radiusAccessAccept          = 2
+    radiusAccessReject          = 3
+    radiusAccessChallenge       = 11
+
+    radiusUserName              = 1
+    radiusUserPassword          = 2
+    radiusReplyMessage          = 18
+    radiusState                 = 24
+    radiusCallingStationID      = 31
+    radiusNASIdentifier         = 32
+    radiusMessageAuthenticator  = 80
+)
+
+const (
+    defaultRADIUSTimeout        = 3 * time.Second
+    defaultRADIUSRetries        = 2
+    radiusMaxPacketSize         = 4096
+)
+
+type radiusAttribute struct {
+    Type        byte
+    Value       []byte
+}
+
+type radiusPacket struct {
+    Code            byte
+    Identifier      byte
+    Authenticator   [16]byte
+    Attributes      []radiusAttribute
+}
+
+// Returned by authRADIUS when the server answers with an Access-Challenge,
+// the response is sent back with the State through keyboard-interactive auth,
+// to the server that issued the challenge (the State is only valid there).
+type RadiusChallengeError struct {
+    Message     string
+    State       []byte
+    Server      string
+}
+
+func (e *RadiusChallengeError) Error() string {
+    return "RADIUS Access-Challenge"
+}
+
+func (p *radiusPacket) get(attrType byte) []byte {
+    for _, attr := range p.Attributes {
+        if attr.Type == attrType {
+            return attr.Value
+        }
+    }
+    return nil
+}
+
+func (p *radiusPacket) add(attrType byte, value []byte) {
+    p.Attributes = append(p.Attributes, radiusAttribute{ Type: attrType, Value: value })
+}
+
+func (p *radiusPacket) encode() ([]byte, error) {
+    b := &bytes.Buffer{}
+    b.Write([]byte{ p.Code, p.Identifier, 0, 0 })
+    b.Write(p.Authenticator[:])
+
+    for _, attr := range p.Attributes {
+        if len(attr.Value) > 253 {
+            return nil, fmt.Errorf("RADIUS attribute %d too long", attr.Type)
+        }
+        b.WriteByte(attr.Type)
+        b.WriteByte(byte(len(attr.Value) + 2))
+        b.Write(attr.Value)
+    }
+
+    data := b.Bytes()
+    if len(data) > radiusMaxPacketSize {
+        return nil, fmt.Errorf("RADIUS packet too long")
+    }
+    binary.BigEndian.PutUint16(data[2:4], uint16(len(data)))
+
+    return data, nil
+}
+
+func decodeRADIUSPacket(data []byte) (*radiusPacket, error) {
+    if len(data) < 20 {
+        return nil, fmt.Errorf("RADIUS packet too short")
+    }
+
+    length := int(binary.BigEndian.Uint16(data[2:4]))
+    if length < 20 || length > len(data) {
+        return nil, fmt.Errorf("Invalid RADIUS packet length")
+    }
+    data = data[:length]
+
+    p := &radiusPacket{
+        Code:           data[0],
+        Identifier:     data[1],
+    }
+    copy(p.Authenticator[:], data[4:20])
+
+    attrs := data[20:]
+    for len(attrs) > 0 {
+        if len(attrs) < 2 || int(attrs[1]) < 2 || int(attrs[1]) > len(attrs) {
+            return nil, fmt.Errorf("Invalid RADIUS attribute")
+        }
+        p.add(attrs[0], append([]byte{}, attrs[2:attrs[1]]...))
+        attrs = attrs[attrs[1]:]
+    }
+
+    return p, nil
+}
+
+// Hides the password as described in RFC 2865 section 5.2.
+func radiusEncryptPassword(password []byte, secret []byte, authenticator []byte) ([]byte, error) {
+    if len(password) > 128 {
+        return nil, fmt.Errorf("Password too long for RADIUS")
+    }
+
+    padded := make([]byte, ((len(password) + 15) / 16) * 16)
+    if len(padded) == 0 {
+        padded = make([]byte, 16)
+    }
+    copy(padded, password)
+
+    result := make([]byte, len(padded))
+    last := authenticator
+    for i := 0; i < len(padded); i += 16 {
+        h := md5.New()
+        h.Write(secret)
+        h.Write(last)
+        sum := h.Sum(nil)
+        for j := 0; j < 16; j++ {
+            result[i+j] = padded[i+j] ^ sum[j]
+        }
+        last = result[i:i+16]
+    }
+
+    return result, nil
+}
+
+// Computes the Message-Authenticator over a packet, with the attribute zeroed
+// and the authenticator field set to the request authenticator.
+func radiusComputeMessageAuthenticator(data []byte, secret []byte, requestAuth []byte) ([]byte, error) {
+    p, err := decodeRADIUSPacket(data)
+    if err != nil {
+        return nil, err
+    }
+    copy(p.Authenticator[:], requestAuth)
+    for i := range p.Attributes {
+        if p.Attributes[i].Type == radiusMessageAuthenticator {
+            p.Attributes[i].Value = make([]byte, 16)
+        }
+    }
+
+    encoded, err := p.encode()
+    if err != nil {
+        return nil, err
+    }
+
+    mac := hmac.New(md5.New, secret)
+    mac.Write(encoded)
+    return mac.Sum(nil), nil
+}
+
+// Checks the response authenticator (and Message-Authenticator if present)
+// of a reply to the given request.
+func radiusVerifyResponse(c *SSHConfig, data []byte, resp *radiusPacket, req *radiusPacket, secret []byte) error {
+    h := md5.New()
+    h.Write(data[:4])
+    h.Write(req.Authenticator[:])
+    h.Write(data[20:binary.BigEndian.Uint16(data[2:4])])
+    h.Write(secret)
+    if ! hmac.Equal(h.Sum(nil), resp.Authenticator[:]) {
+        return fmt.Errorf("Invalid RADIUS response authenticator")
+    }
+
+    if msgAuth := resp.get(radiusMessageAuthenticator); msgAuth != nil {
+        expected, err := radiusComputeMessageAuthenticator(data, secret, req.Authenticator[:])
+        if err != nil {
+            return err
+        }
+        if ! hmac.Equal(msgAuth, expected) {
+            return fmt.Errorf("Invalid RADIUS Message-Authenticator")
+        }
+    } else if c.Global.RADIUS_RequireMessageAuthenticator {
+        return fmt.Errorf("RADIUS response missing Message-Authenticator")
+    }
+
+    return nil
+}
+
+func newRADIUSRequest(c *SSHConfig, username string, password []byte, state []byte, remoteAddr net.Addr) (*radiusPacket, []byte, error) {
+    secret := []byte(c.Global.RADIUS_Secret)
+
+    req := &radiusPacket{ Code: radiusAccessRequest }
+    if _, err := rand.Read(req.Authenticator[:]); err != nil {
+        return nil, nil, err
+    }
+    id := make([]byte, 1)
+    if _, err := rand.Read(id); err != nil {
+        return nil, nil, err
+    }
+    req.Identifier = id[0]
+
+    encPassword, err := radiusEncryptPassword(password, secret, req.Authenticator[:])
+    if err != nil {
+        return nil, nil, err
+    }
+
+    nasIdentifier := c.Global.RADIUS_NASIdentifier
+    if len(nasIdentifier) == 0 {
+        nasIdentifier = "ssh-bastion"
+    }
+
+    req.add(radiusUserName, []byte(username))
+    req.add(radiusUserPassword, encPassword)
+    req.add(radiusNASIdentifier, []byte(nasIdentifier))
+    req.add(radiusCallingStationID, []byte(remoteIP(remoteAddr)))
+    if state != nil {
+        req.add(radiusState, state)
+    }
+    req.add(radiusMessageAuthenticator, make([]byte, 16))
+
+    data, err := req.encode()
+    if err != nil {
+        return nil, nil, err
+    }
+    msgAuth, err := radiusComputeMessageAuthenticator(data, secret, req.Authenticator[:])
+    if err != nil {
+        return nil, nil, err
+    }
+    copy(data[len(data)-16:], msgAuth)
+
+    return req, data, nil
+}
+
+// Sends a request to a single server, retrying on timeout.
+func radiusExchange(c *SSHConfig, server string, req *radiusPacket, data []byte, timeout time.Duration, retries int) (*radiusPacket, error) {
+    conn, err := net.Dial("udp", server)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    buf := make([]byte, radiusMaxPacketSize)
+    for attempt := 0; attempt <= retries; attempt++ {
+        if _, err := conn.Write(data); err != nil {
+            return nil, err
+        }
+
+        conn.SetReadDeadline(time.Now().Add(timeout))
+        for {
+            n, err := conn.Read(buf)
+            if err != nil {
+                if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+                    break
+                }
+                return nil, err
+            }
+
+            resp, err := decodeRADIUSPacket(buf[:n])
+            if err != nil || resp.Identifier != req.Identifier {
+                // Stray or malformed datagram, keep waiting for our reply.
+                continue
+            }
+            if err := radiusVerifyResponse(c, buf[:n], resp, req, []byte(c.Global.RADIUS_Secret)); err != nil {
+                log.Printf("Discarding RADIUS response from %s: %s", server, err)
+                continue
+            }
+
+            return resp, nil
+        }
+    }
+
+    return nil, fmt.Errorf("No response after %d attempts", retries + 1)
+}
+
+// Returns the per-server timeout and number of retries.
+func radiusRetryOptions(c *SSHConfig) (time.Duration, int, error) {
+    timeout, err := parseDurationOption("radius_timeout", c.Global.RADIUS_Timeout, defaultRADIUSTimeout)
+    if err != nil {
+        return 0, 0, err
+    }
+    retries := defaultRADIUSRetries
+    if c.Global.RADIUS_Retries > 0 {
+        retries = c.Global.RADIUS_Retries
+    }
+    return timeout, retries, nil
+}
+
+// Sends an Access-Request to each configured server in turn until one
+// answers, returning the answer and the server it came from.
+func radiusRequest(c *SSHConfig, username string, password []byte, state []byte, remoteAddr net.Addr) (*radiusPacket, string, error) {
+    if len(c.Global.RADIUS_Servers) == 0 {
+        return nil, "", fmt.Errorf("No RADIUS servers configured")
+    }
+
+    timeout, retries, err := radiusRetryOptions(c)
+    if err != nil {
+        return nil, "", err
+    }
+
+    for _, server := range c.Global.RADIUS_Servers {
+        req, data, err := newRADIUSRequest(c, username, password, state, remoteAddr)
+        if err != nil {
+            return nil, "", err
+        }
+
+        resp, err := radiusExchange(c, server, req, data, timeout, retries)
+        if err != nil {
+            log.Printf("RADIUS server (%s) failed: %s", server, err)
+            continue
+        }
+        return resp, server, nil
+    }
+
+    return nil, "", fmt.Errorf("No RADIUS servers responded")
+}
+
+func radiusResult(username string, server string, resp *radiusPacket) error {
+    switch resp.Code {
+        case radiusAccessAccept:
+            return nil
+        case radiusAccessChallenge:
+            return &RadiusChallengeError{
+                Message:    string(resp.get(radiusReplyMessage)),
+                State:      resp.get(radiusState),
+                Server:     server,
+            }
+        case radiusAccessReject:
+            log.Printf("RADIUS Access-Reject for user (%s): %s", username, resp.get(radiusReplyMessage))
+            return fmt.Errorf("RADIUS Access Rejected")
+        default:
+            return fmt.Errorf("Unexpected RADIUS response code %d", resp.Code)
+    }
+}
+
+func init() {
+    RegisterAuthenticator("radius", AuthenticatorFunc(authRADIUS))
+}
+
+// Authenticates with PAP against the configured RADIUS servers. A challenge
+// from the server is returned as a RadiusChallengeError.
+func authRADIUS(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    resp, server, err := radiusRequest(c, conn.User(), password, nil, conn.RemoteAddr())
+    if err != nil {
+        log.Printf("RADIUS Auth Failed for user (%s): %s", conn.User(), err)
+        return nil, fmt.Errorf("RADIUS Auth Failed: %s", err)
+    }
+
+    return nil, radiusResult(conn.User(), server, resp)
+}
+
+// Asks the user to answer the challenge via keyboard-interactive.
+func (e *RadiusChallengeError) Respond(c *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (map[string]string, error) {
+    return nil, radiusChallengeResponse(c, conn, client, e)
+}
+
+// Answers RADIUS challenges through keyboard-interactive prompts until the
+// server accepts or rejects the user. Answers only go to the server that
+// issued the challenge, there's no failing over to the others.
+func radiusChallengeResponse(c *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, challenge *RadiusChallengeError) error {
+    timeout, retries, err := radiusRetryOptions(c)
+    if err != nil {
+        return err
+    }
+
+    for {
+        prompt := challenge.Message
+        if len(prompt) == 0 {
+            prompt = "Response: "
+        }
+
+        answers, err := client("", "", []string{ prompt }, []bool{ false })
+        if err != nil {
+            return err
+        }
+        if len(answers) != 1 {
+            return fmt.Errorf("Invalid RADIUS Challenge Response")
+        }
+
+        req, data, err := newRADIUSRequest(c, conn.User(), []byte(answers[0]), challenge.State, conn.RemoteAddr())
+        if err != nil {
+            return err
+        }
+        resp, err := radiusExchange(c, challenge.Server, req, data, timeout, retries)
+        if err != nil {
+            log.Printf("RADIUS Auth Failed for user (%s): server (%s) failed: %s", conn.User(), challenge.Server, err)
+            return fmt.Errorf("RADIUS Auth Failed: %s", err)
+        }
+
+        err = radiusResult(conn.User(), challenge.Server, resp)
+        if next, ok := err.(*RadiusChallengeError); ok {
+            challenge = next
+            continue
+        }
+        return err
+    }
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "net"
+    "bytes"
+    "testing"
+    "sync/atomic"
+    "crypto/md5"
+)
+
+// Answers Access-Requests like a RADIUS server, signing the replies with its
+// secret. The handler gets the request and its decrypted password.
+type testRADIUSServer struct {
+    conn        net.PacketConn
+    secret      []byte
+    handler     func(req *radiusPacket, password string) *radiusPacket
+}
+
+func newTestRADIUSServer(t *testing.T, secret string, handler func(req *radiusPacket, password string) *radiusPacket) string {
+    conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { conn.Close() })
+
+    s := &testRADIUSServer{ conn: conn, secret: []byte(secret), handler: handler }
+    go s.serve()
+    return conn.LocalAddr().String()
+}
+
+func (s *testRADIUSServer) serve() {
+    buf := make([]byte, radiusMaxPacketSize)
+    for {
+        n, addr, err := s.conn.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        req, err := decodeRADIUSPacket(buf[:n])
+        if err != nil {
+            continue
+        }
+
+        resp := s.handler(req, s.decryptPassword(req))
+        resp.Identifier = req.Identifier
+        if data, err := s.sign(resp, req); err == nil {
+            s.conn.WriteTo(data, addr)
+        }
+    }
+}
+
+// Reverses radiusEncryptPassword.
+func (s *testRADIUSServer) decryptPassword(req *radiusPacket) string {
+    hidden := req.get(radiusUserPassword)
+    password := make([]byte, len(hidden))
+    last := req.Authenticator[:]
+    for i := 0; i + 16 <= len(hidden); i += 16 {
+        sum := md5.Sum(append(append([]byte{}, s.secret...), last...))
+        for j := 0; j < 16; j++ {
+            password[i+j] = hidden[i+j] ^ sum[j]
+        }
+        last = hidden[i:i+16]
+    }
+    return string(bytes.TrimRight(password, "\x00"))
+}
+
+// Adds the Message-Authenticator and the response authenticator.
+func (s *testRADIUSServer) sign(resp *radiusPacket, req *radiusPacket) ([]byte, error) {
+    resp.add(radiusMessageAuthenticator, make([]byte, 16))
+    data, err := resp.encode()
+    if err != nil {
+        return nil, err
+    }
+    msgAuth, err := radiusComputeMessageAuthenticator(data, s.secret, req.Authenticator[:])
+    if err != nil {
+        return nil, err
+    }
+    copy(data[len(data)-16:], msgAuth)
+
+    h := md5.New()
+    h.Write(data[:4])
+    h.Write(req.Authenticator[:])
+    h.Write(data[20:])
+    h.Write(s.secret)
+    copy(data[4:20], h.Sum(nil))
+    return data, nil
+}
+
+// Accepts "secret" outright and "otp" after a challenge answered with "123456".
+func testRADIUSHandler(req *radiusPacket, password string) *radiusPacket {
+    resp := &radiusPacket{ Code: radiusAccessReject }
+    switch {
+        case string(req.get(radiusUserName)) != "alice":
+        case req.get(radiusState) == nil && password == "secret":
+            resp.Code = radiusAccessAccept
+        case req.get(radiusState) == nil && password == "otp":
+            resp.Code = radiusAccessChallenge
+            resp.add(radiusReplyMessage, []byte("Token code: "))
+            resp.add(radiusState, []byte("state-1"))
+        case string(req.get(radiusState)) == "state-1" && password == "123456":
+            resp.Code = radiusAccessAccept
+        default:
+            resp.add(radiusReplyMessage, []byte("Invalid credentials"))
+    }
+    return resp
+}
+
+func testRADIUSConfig(servers ...string) *SSHConfig {
+    c := &SSHConfig{}
+    c.Global.RADIUS_Servers = servers
+    c.Global.RADIUS_Secret = "radius-secret"
+    c.Global.RADIUS_Timeout = "200ms"
+    c.Global.RADIUS_Retries = 1
+    c.Global.RADIUS_RequireMessageAuthenticator = true
+    return c
+}
+
+func TestRADIUSAcceptReject(t *testing.T) {
+    c := testRADIUSConfig(newTestRADIUSServer(t, "radius-secret", testRADIUSHandler))
+
+    if _, err := authRADIUS(c, testConnMetadata{ user: "alice" }, []byte("secret")); err != nil {
+        t.Errorf("Expected Access-Accept, got %v", err)
+    }
+    if _, err := authRADIUS(c, testConnMetadata{ user: "alice" }, []byte("wrong")); err == nil {
+        t.Errorf("Expected Access-Reject to fail")
+    }
+}
+
+func TestRADIUSChallenge(t *testing.T) {
+    c := testRADIUSConfig(newTestRADIUSServer(t, "radius-secret", testRADIUSHandler))
+    conn := testConnMetadata{ user: "alice" }
+
+    _, err := authRADIUS(c, conn, []byte("otp"))
+    challenge, ok := err.(*RadiusChallengeError)
+    if ! ok {
+        t.Fatalf("Expected an Access-Challenge, got %v", err)
+    }
+    if challenge.Message != "Token code: " || string(challenge.State) != "state-1" {
+        t.Errorf("Unexpected challenge %+v", challenge)
+    }
+
+    for answer, accepted := range map[string]bool{ "123456": true, "654321": false } {
+        var prompts []string
+        client := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+            prompts = append(prompts, questions...)
+            return []string{ answer }, nil
+        }
+
+        _, err := challenge.Respond(c, conn, client)
+        if ( err == nil ) != accepted {
+            t.Errorf("%s: unexpected result %v", answer, err)
+        }
+        if len(prompts) != 1 || prompts[0] != "Token code: " {
+            t.Errorf("%s: unexpected prompts %v", answer, prompts)
+        }
+    }
+}
+
+// Replies signed with another secret are discarded, so the request times out.
+func TestRADIUSBadAuthenticator(t *testing.T) {
+    c := testRADIUSConfig(newTestRADIUSServer(t, "other-secret", testRADIUSHandler))
+
+    if _, err := authRADIUS(c, testConnMetadata{ user: "alice" }, []byte("secret")); err == nil {
+        t.Errorf("Expected a reply with a bad authenticator to be rejected")
+    }
+}
+
+func TestRADIUSFailover(t *testing.T) {
+    var firstRequests int32
+    first := newTestRADIUSServer(t, "other-secret", func(req *radiusPacket, password string) *radiusPacket {
+        atomic.AddInt32(&firstRequests, 1)
+        return testRADIUSHandler(req, password)
+    })
+    second := newTestRADIUSServer(t, "radius-secret", testRADIUSHandler)
+    c := testRADIUSConfig(first, second)
+    conn := testConnMetadata{ user: "alice" }
+
+    if _, err := authRADIUS(c, conn, []byte("secret")); err != nil {
+        t.Errorf("Expected the second server to accept, got %v", err)
+    }
+
+    // The answer to a challenge goes only to the server that issued it.
+    _, err := authRADIUS(c, conn, []byte("otp"))
+    challenge, ok := err.(*RadiusChallengeError)
+    if ! ok {
+        t.Fatalf("Expected an Access-Challenge from the second server, got %v", err)
+    }
+    if challenge.Server != second {
+        t.Errorf("Expected the challenge from %s, got %s", second, challenge.Server)
+    }
+
+    sent := atomic.LoadInt32(&firstRequests)
+    client := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+        return []string{ "123456" }, nil
+    }
+    if _, err := challenge.Respond(c, conn, client); err != nil {
+        t.Errorf("Expected the answer to be accepted, got %v", err)
+    }
+    if n := atomic.LoadInt32(&firstRequests); n != sent {
+        t.Errorf("Expected no answer sent to the first server, got %d requests", n - sent)
+    }
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "net"
+    "sort"
+    "sync"
+    "time"
+    "io/ioutil"
+    "encoding/json"
+    "golang.org/x/crypto/ssh"
+)
+
+const (
+    defaultAuthFailureWindow    = 10 * time.Minute
+    defaultAuthBanTime          = 5 * time.Minute
+    defaultAuthMaxBanTime       = 24 * time.Hour
+)
+
+// How often expired entries are pruned and changes written to the state file.
+// New bans are written straight away.
+const authLimitSaveInterval = 10 * time.Second
+
+// Most entries kept, so failures spread over many usernames or source
+// addresses can't grow the state without limit. Beyond it the entries
+// without a ban are dropped first, oldest first.
+const maxAuthLimitEntries = 100000
+
+// Returned by the auth callbacks when the source address or user is banned,
+// so the attempt isn't counted as another failure.
+type BannedError struct {
+    Key         string
+    Until       time.Time
+}
+
+func (e *BannedError) Error() string {
+    return fmt.Sprintf("Temporarily Banned (%s) until %s", e.Key, e.Until.Format(time.RFC3339))
+}
+
+type authLimitEntry struct {
+    Failures        int             `json:"failures"`
+    FirstFailure    time.Time       `json:"first_failure"`
+    Bans            int             `json:"bans"`
+    BannedUntil     time.Time       `json:"banned_until"`
+}
+
+// Tracks failed authentication attempts per source IP and per username,
+// banning either once its threshold is reached. Each repeated ban doubles
+// in length, up to the maximum ban time, and state is kept in a file so
+// bans survive restarts.
+type AuthLimiter struct {
+    Entries         map[string]*authLimitEntry      `json:"entries"`
+    maxPerIP        int
+    maxPerUser      int
+    window          time.Duration
+    banTime         time.Duration
+    maxBanTime      time.Duration
+    stateFile       string
+    dirty           bool
+    mutex           *sync.Mutex
+}
+
+var authLimiter *AuthLimiter
+
+func parseDurationOption(name string, value string, def time.Duration) (time.Duration, error) {
+    if len(value) == 0 {
+        return def, nil
+    }
+    d, err := time.ParseDuration(value)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid %s (%s): %s", name, value, err)
+    }
+    return d, nil
+}
+
+// Creates the limiter from the global config, returning nil if no thresholds are set.
+func NewAuthLimiter() (*AuthLimiter, error) {
+    if getConfig().Global.MaxAuthFailuresPerIP <= 0 && getConfig().Global.MaxAuthFailuresPerUser <= 0 {
+        return nil, nil
+    }
+
+    a := &AuthLimiter{
+        Entries:        map[string]*authLimitEntry{},
+        maxPerIP:       getConfig().Global.MaxAuthFailuresPerIP,
+        maxPerUser:     getConfig().Global.MaxAuthFailuresPerUser,
+        stateFile:      getConfig().Global.AuthBanStateFile,
+        mutex:          &sync.Mutex{},
+    }
+
+    var err error
+    if a.window, err = parseDurationOption("auth_failure_window", getConfig().Global.AuthFailureWindow, defaultAuthFailureWindow); err != nil {
+        return nil, err
+    }
+    if a.banTime, err = parseDurationOption("auth_ban_time", getConfig().Global.AuthBanTime, defaultAuthBanTime); err != nil {
+        return nil, err
+    }
+    if a.maxBanTime, err = parseDurationOption("auth_max_ban_time", getConfig().Global.AuthMaxBanTime, defaultAuthMaxBanTime); err != nil {
+        return nil, err
+    }
+
+    if len(a.stateFile) > 0 {
+        data, err := ioutil.ReadFile(a.stateFile)
+        if err != nil && ! os.IsNotExist(err) {
+            return nil, fmt.Errorf("Unable to read auth ban state file (%s): %s", a.stateFile, err)
+        } else if err == nil {
+            if err := json.Unmarshal(data, a); err != nil {
+                return nil, fmt.Errorf("Unable to parse auth ban state file (%s): %s", a.stateFile, err)
+            }
+            if a.Entries == nil {
+                a.Entries = map[string]*authLimitEntry{}
+            }
+        }
+    }
+
+    go a.maintain()
+
+    return a, nil
+}
+
+// Periodically prunes entries and writes any changes to the state file.
+func (a *AuthLimiter) maintain() {
+    ticker := time.NewTicker(authLimitSaveInterval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        a.mutex.Lock()
+        a.prune(time.Now())
+        if a.dirty {
+            a.save()
+        }
+        a.mutex.Unlock()
+    }
+}
+
+// Returns whether an entry is banned, or remembered as having been banned
+// recently enough for the next ban to be longer.
+func (a *AuthLimiter) banned(entry *authLimitEntry, now time.Time) bool {
+    return now.Before(entry.BannedUntil) || ( entry.Bans > 0 && now.Sub(entry.BannedUntil) <= a.maxBanTime )
+}
+
+// Drops the entries that no longer hold any state worth keeping, those whose
+// failures are outside of the window and without a ban, then the oldest
+// entries while there are more than maxAuthLimitEntries.
+func (a *AuthLimiter) prune(now time.Time) {
+    for key, entry := range a.Entries {
+        if ( entry.Failures == 0 || now.Sub(entry.FirstFailure) > a.window ) && ! a.banned(entry, now) {
+            delete(a.Entries, key)
+            a.dirty = true
+        }
+    }
+
+    if len(a.Entries) <= maxAuthLimitEntries {
+        return
+    }
+
+    keys := make([]string, 0, len(a.Entries))
+    for key := range a.Entries {
+        keys = append(keys, key)
+    }
+    sort.Slice(keys, func(i, j int) bool {
+        ei, ej := a.Entries[keys[i]], a.Entries[keys[j]]
+        if bi, bj := a.banned(ei, now), a.banned(ej, now); bi != bj {
+            return bj
+        } else if bi {
+            return ei.BannedUntil.Before(ej.BannedUntil)
+        }
+        return ei.FirstFailure.Before(ej.FirstFailure)
+    })
+
+    // Evict down to 90% of the limit, so a flood doesn't sort on every failure.
+    for _, key := range keys[:len(keys) - maxAuthLimitEntries * 9 / 10] {
+        delete(a.Entries, key)
+    }
+    a.dirty = true
+}
+
+func remoteIP(addr net.Addr) string {
+    if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+        return tcpAddr.IP.String()
+    }
+    host, _, err := net.SplitHostPort(addr.String())
+    if err != nil {
+        return addr.String()
+    }
+    return host
+}
+
+func (a *AuthLimiter) keys(conn ssh.ConnMetadata) map[string]int {
+    keys := map[string]int{}
+    if a.maxPerIP > 0 {
+        keys["ip:" + remoteIP(conn.RemoteAddr())] = a.maxPerIP
+    }
+    if a.maxPerUser > 0 {
+        keys["user:" + conn.User()] = a.maxPerUser
+    }
+    return keys
+}
+
+// Returns a BannedError if the source address or user is currently banned.
+func (a *AuthLimiter) Check(conn ssh.ConnMetadata) error {
+    if a == nil {
+        return nil
+    }
+
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    now := time.Now()
+    for key := range a.keys(conn) {
+        if entry, ok := a.Entries[key]; ok && now.Before(entry.BannedUntil) {
+            return &BannedError{ Key: key, Until: entry.BannedUntil }
+        }
+    }
+
+    return nil
+}
+
+func (a *AuthLimiter) Failure(conn ssh.ConnMetadata) {
+    if a == nil {
+        return
+    }
+
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    now := time.Now()
+    newBan := false
+    for key, max := range a.keys(conn) {
+        entry, ok := a.Entries[key]
+        if ! ok {
+            entry = &authLimitEntry{}
+            a.Entries[key] = entry
+            if len(a.Entries) > maxAuthLimitEntries {
+                a.prune(now)
+            }
+        }
+
+        // Repeat offences are forgotten once a maximum ban time passes without a ban.
+        if entry.Bans > 0 && now.Sub(entry.BannedUntil) > a.maxBanTime {
+            entry.Bans = 0
+        }
+
+        if entry.Failures == 0 || now.Sub(entry.FirstFailure) > a.window {
+            entry.Failures = 0
+            entry.FirstFailure = now
+        }
+        entry.Failures += 1
+
+        if entry.Failures >= max {
+            banTime := a.banTime
+            for i := 0; i < entry.Bans && banTime < a.maxBanTime; i++ {
+                banTime *= 2
+            }
+            if banTime > a.maxBanTime {
+                banTime = a.maxBanTime
+            }
+
+            entry.Bans += 1
+            entry.Failures = 0
+            entry.BannedUntil = now.Add(banTime)
+            WriteAuthLog("Banned %s for %s after %d failed authentication attempts (ban %d).", key, banTime, max, entry.Bans)
+            newBan = true
+        }
+    }
+
+    a.dirty = true
+    if newBan {
+        a.save()
+    }
+}
+
+// Clears the failure counts (but not the ban history) after a successful login.
+func (a *AuthLimiter) Success(conn ssh.ConnMetadata) {
+    if a == nil {
+        return
+    }
+
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    for key := range a.keys(conn) {
+        if entry, ok := a.Entries[key]; ok && entry.Failures > 0 {
+            entry.Failures = 0
+            a.dirty = true
+        }
+    }
+}
+
+// Writes the entries to the state file, with the mutex held.
+func (a *AuthLimiter) save() {
+    a.dirty = false
+    if len(a.stateFile) == 0 {
+        return
+    }
+
+    data, err := json.Marshal(a)
+    if err != nil {
+        log.Printf("Unable to encode auth ban state: %s", err)
+        return
+    }
+
+    tmpFile := a.stateFile + ".tmp"
+    if err := ioutil.WriteFile(tmpFile, data, 0600); err != nil {
+        log.Printf("Unable to write auth ban state file (%s): %s", tmpFile, err)
+        return
+    }
+    if err := os.Rename(tmpFile, a.stateFile); err != nil {
+        log.Printf("Unable to write auth ban state file (%s): %s", a.stateFile, err)
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "time"
+    "testing"
+)
+
+func newTestAuthLimiter() *AuthLimiter {
+    return &AuthLimiter{
+        Entries:        map[string]*authLimitEntry{},
+        maxPerIP:       3,
+        maxPerUser:     3,
+        window:         10 * time.Minute,
+        banTime:        5 * time.Minute,
+        maxBanTime:     time.Hour,
+        mutex:          &sync.Mutex{},
+    }
+}
+
+func TestAuthLimiterPrune(t *testing.T) {
+    a := newTestAuthLimiter()
+    now := time.Now()
+
+    a.Entries["user:expired"] = &authLimitEntry{ Failures: 2, FirstFailure: now.Add(-time.Hour) }
+    a.Entries["user:recent"] = &authLimitEntry{ Failures: 1, FirstFailure: now.Add(-time.Minute) }
+    a.Entries["user:banned"] = &authLimitEntry{ Bans: 1, BannedUntil: now.Add(time.Minute) }
+    a.Entries["user:remembered"] = &authLimitEntry{ Bans: 1, BannedUntil: now.Add(-30 * time.Minute) }
+    a.Entries["user:forgotten"] = &authLimitEntry{ Bans: 1, BannedUntil: now.Add(-2 * time.Hour) }
+
+    a.prune(now)
+
+    for _, key := range []string{ "user:recent", "user:banned", "user:remembered" } {
+        if _, ok := a.Entries[key]; ! ok {
+            t.Errorf("Expected %s to be kept", key)
+        }
+    }
+    for _, key := range []string{ "user:expired", "user:forgotten" } {
+        if _, ok := a.Entries[key]; ok {
+            t.Errorf("Expected %s to be pruned", key)
+        }
+    }
+}
+
+func TestAuthLimiterPruneLimit(t *testing.T) {
+    a := newTestAuthLimiter()
+    now := time.Now()
+
+    a.Entries["user:banned"] = &authLimitEntry{ Bans: 1, BannedUntil: now.Add(time.Minute), FirstFailure: now.Add(-5 * time.Minute) }
+    for i := 0; i < maxAuthLimitEntries; i++ {
+        a.Entries[fmt.Sprintf("user:%d", i)] = &authLimitEntry{ Failures: 1, FirstFailure: now.Add(-time.Duration(i) * time.Millisecond) }
+    }
+
+    a.prune(now)
+
+    if len(a.Entries) > maxAuthLimitEntries {
+        t.Fatalf("Expected at most %d entries, got %d", maxAuthLimitEntries, len(a.Entries))
+    }
+    if _, ok := a.Entries["user:banned"]; ! ok {
+        t.Errorf("Expected the banned entry to be kept over those without a ban")
+    }
+    if _, ok := a.Entries["user:0"]; ! ok {
+        t.Errorf("Expected the newest entry to be kept")
+    }
+    if _, ok := a.Entries[fmt.Sprintf("user:%d", maxAuthLimitEntries - 1)]; ok {
+        t.Errorf("Expected the oldest entry to be dropped")
+    }
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "time"
+    "strings"
+    "sync/atomic"
+)
+
+// How often the config file is checked for changes.
+const configPollInterval = 5 * time.Second
+
+var currentConfig atomic.Value
+
+// Returns the config currently in use. Callers that need several values to be
+// consistent with each other (e.g. a session) should keep the result rather
+// than calling this again, as the config may be replaced at any time.
+func getConfig() *SSHConfig {
+    c, _ := currentConfig.Load().(*SSHConfig)
+    return c
+}
+
+func setConfig(c *SSHConfig) {
+    currentConfig.Store(c)
+}
+
+// Loads and validates the config file, only replacing the current config if
+// there are no problems with it.
+func reloadConfig(reason string) {
+    c, problems, err := checkConfigFile(opts.Config)
+    if err != nil {
+        log.Printf("Config reload (%s) failed, keeping the current config: %s", reason, err)
+        return
+    }
+    if len(problems) > 0 {
+        for _, problem := range problems {
+            log.Printf("Config problem: %s", problem)
+        }
+        log.Printf("Config reload (%s) failed with %d problem(s), keeping the current config", reason, len(problems))
+        return
+    }
+
+    setConfig(c)
+    log.Printf("Reloaded config from %s (%s)", opts.Config, reason)
+}
+
+// Describes the modification time and size of the config file and the
+// files it currently includes, to notice when any of them change.
+func configFilesState() string {
+    files := []string{ opts.Config }
+    if included, err := includeFiles(opts.Config, getConfig().Include); err == nil {
+        files = append(files, included...)
+    }
+
+    var state []string
+    for _, file := range files {
+        if info, err := os.Stat(file); err == nil {
+            state = append(state, fmt.Sprintf("%s %d %d", file, info.ModTime().UnixNano(), info.Size()))
+        }
+    }
+    return strings.Join(state, "\n")
+}
+
+// Reloads the config on SIGHUP (delivered to hup), or when the modification
+// time or size of the config file or its includes change (or files are added
+// or removed). Existing connections keep the config they authenticated with.
+func watchConfig(hup <-chan os.Signal) {
+    state := configFilesState()
+
+    ticker := time.NewTicker(configPollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-hup:
+                reloadConfig("SIGHUP")
+                state = configFilesState()
+            case <-ticker.C:
+                if current := configFilesState(); current != state {
+                    state = current
+                    reloadConfig("file changed")
+                }
+        }
+    }
+}
@@ -3,9 +3,7 @@ package main
 import (
     "fmt"
     "net"
-    "log"
     "time"
-    "bytes"
     "io/ioutil"
     "golang.org/x/crypto/ssh"
 )
@@ -19,56 +17,10 @@ func NewSSHServer() (*SSHServer, error) {
         sshConfig:      &ssh.ServerConfig{
             NoClientAuth:       false,
             ServerVersion:      "SSH-2.0-BASTION",
-            AuthLogCallback:    func(conn ssh.ConnMetadata, method string, err error){
-                if err != nil {
-                    WriteAuthLog("Failed %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
-                } else {
-                    WriteAuthLog("Accepted %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
-                }
-            },
-            PasswordCallback:   AuthUserPass,
-            PublicKeyCallback:  func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-                if user, ok := config.Users[conn.User()]; ! ok {
-                    return nil, fmt.Errorf("User Not Found in Config for PK")
-                } else {
-                    if len(user.AuthorizedKeysFile) > 0 {
-                        authKeysData, err := ioutil.ReadFile(user.AuthorizedKeysFile)
-                        if err != nil {
-                            log.Printf("Unable to read authorized keys file (%s) for user (%s): %s.", user.AuthorizedKeysFile, conn.User(), err)
-                            return nil, fmt.Errorf("Unable to read Authorized Keys file.")
-                        }
-
-                        for {
-                            if len(authKeysData) > 0 {
-                                var authKey ssh.PublicKey
-                                var err error
-                                authKey, _, _, authKeysData, err = ssh.ParseAuthorizedKey(authKeysData)
-                                if err != nil {
-                                    log.Printf("Error while processing authorized keys file (%s) for user (%s)", user.AuthorizedKeysFile, conn.User(), err)
-                                    return nil, fmt.Errorf("Error while processing authorized keys file.")
-                                }
-
-                                if ( key.Type() == authKey.Type() ) && ( bytes.Compare(key.Marshal(), authKey.Marshal()) == 0 ) {
-                                    perm := &ssh.Permissions{
-                                        Extensions: map[string]string{
-                                            "authType":     "pk",
-                                        },
-                                    }
-                                    return perm, nil
-                                }
-                            } else {
-                                return nil, fmt.Errorf("No PKs Match - ACCESS DENIED")
-                            }
-                        }
-                    } else {
-                        return nil, fmt.Errorf("User has not authorized keys file specified.")
-                    }
-                }
-            },
         },
     }
 
-    for _, keyPath := range config.Global.HostKeyPaths {
+    for _, keyPath := range getConfig().Global.HostKeyPaths {
         hostKey, err := ioutil.ReadFile(keyPath)
         if err != nil {
             return nil, fmt.Errorf("Unable to read host key file (%s): %s", keyPath, err)
@@ -85,6 +37,30 @@ func NewSSHServer() (*SSHServer, error) {
     return s, nil
 }
 
+// Returns the server config for a new connection, with auth callbacks using
+// the config snapshot that the connection keeps for its whole life.
+func (s *SSHServer) connConfig(c *SSHConfig) *ssh.ServerConfig {
+    config := *s.sshConfig
+    config.AuthLogCallback = func(conn ssh.ConnMetadata, method string, err error){
+        if _, ok := err.(*ssh.PartialSuccessError); ok {
+            WriteAuthLog("Partial %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
+        } else if err != nil {
+            WriteAuthLog("Failed %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
+
+            // Public key offers fail routinely, only count guessable secrets.
+            if _, banned := err.(*BannedError); ! banned && (method == "password" || method == "keyboard-interactive") {
+                authLimiter.Failure(bastionConn(c, conn))
+            }
+        } else {
+            WriteAuthLog("Accepted %s for user %s from %s ssh2", method, conn.User(), conn.RemoteAddr())
+            authLimiter.Success(bastionConn(c, conn))
+        }
+    }
+    config.PasswordCallback = passwordStep(c, nil)
+    config.PublicKeyCallback = publicKeyStep(c, nil)
+    return &config
+}
+
 func (s *SSHServer) ListenAndServe(addr string) (error) {
     l, err := net.Listen("tcp", addr)
     if err != nil {
@@ -109,7 +85,10 @@ func (s *SSHServer) HandleConn(c net.Conn) {
     //log.Printf("Starting Accept SSH Connection...")
     startTime := time.Now()
 
-    sshConn, chans, reqs, err := ssh.NewServerConn(c, s.sshConfig)
+    // Auth and the session use the same config, even if it is reloaded meanwhile.
+    config := getConfig()
+
+    sshConn, chans, reqs, err := ssh.NewServerConn(c, s.connConfig(config))
     if err != nil {
         //log.Printf("Exiting as there is a config problem...")
         c.Close()
@@ -117,12 +96,20 @@ func (s *SSHServer) HandleConn(c net.Conn) {
     }
     defer WriteAuthLog("Connection closed by %s (User: %s).", sshConn.RemoteAddr(), sshConn.User())
 
+    // A target in the username (e.g. "alice+vdev2") is used by the session in
+    // place of the menus, everything else sees the bastion user.
+    target := parseUserTarget(config, sshConn.User())
+    sshConn = &ssh.ServerConn{ Conn: bastionSSHConn{ Conn: sshConn.Conn, user: target.User }, Permissions: sshConn.Permissions }
+
     if sshConn.Permissions == nil || sshConn.Permissions.Extensions == nil {
         //log.Printf("Exiting as there is an authentication problem...")
         sshConn.Close()
         return
     }
 
+    credentials.Claim(sshConn.SessionID())
+    defer credentials.Clear(sshConn.SessionID())
+
     go ssh.DiscardRequests(reqs)
     newChannel := <-chans
     if newChannel == nil {
@@ -133,7 +120,7 @@ func (s *SSHServer) HandleConn(c net.Conn) {
 
     switch newChannel.ChannelType() {
         case "session":
-            s.SessionForward(startTime, sshConn, newChannel, chans)
+            s.SessionForward(config, startTime, sshConn, target, newChannel, chans)
         default:
             newChannel.Reject(ssh.UnknownChannelType, "connection flow not supported, only interactive sessions are permitted.")
     }
@@ -141,3 +128,28 @@ func (s *SSHServer) HandleConn(c net.Conn) {
     //log.Printf("ALL OK, closing as nothing left to do...")
     sshConn.Close()
 }
+
+// Applies the checks that follow a successful authentication (source address
+// restrictions, auth_methods and TOTP), including to the result of any further
+// steps a backend asked for through partial success (e.g. a RADIUS challenge).
+// The permissions of earlier steps (prev) are combined with those of this one.
+func finishAuth(c *SSHConfig, conn ssh.ConnMetadata, method string, prev *ssh.Permissions, perm *ssh.Permissions, err error) (*ssh.Permissions, error) {
+    if partial, ok := err.(*ssh.PartialSuccessError); ok {
+        if next := partial.Next.KeyboardInteractiveCallback; next != nil {
+            partial.Next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+                conn = bastionConn(c, conn)
+                perm, err := next(conn, client)
+                return finishAuth(c, conn, method, prev, perm, err)
+            }
+        }
+        return nil, partial
+    }
+
+    if err == nil {
+        perm = mergePermissions(prev, perm)
+    }
+
+    perm, err = authorizeConn(c, conn, perm, err)
+    perm, err = withAuthMethods(c, conn, method, perm, err)
+    return withTOTP(c, conn, perm, err)
+}
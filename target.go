@@ -0,0 +1,79 @@
+package main
+
+import (
+    "strings"
+    "golang.org/x/crypto/ssh"
+)
+
+// The parts of a username that names its target, e.g. "alice+vdev2",
+// "alice@vdev2" or "alice%deploy@vdev2" (the remote account to log in as).
+type userTarget struct {
+    User        string
+    LoginUser   string
+    Server      string
+}
+
+// Splits a username into the bastion user and any target. A username that
+// is a user in the config is never split.
+func parseUserTarget(c *SSHConfig, username string) userTarget {
+    target := userTarget{ User: username }
+    if _, known := c.Users[username]; known {
+        return target
+    }
+
+    if i := strings.LastIndexAny(username, "+@"); i >= 0 {
+        target.User, target.Server = username[:i], username[i+1:]
+    }
+    if i := strings.Index(target.User, "%"); i >= 0 {
+        target.User, target.LoginUser = target.User[:i], target.User[i+1:]
+    }
+    return target
+}
+
+// Resolves a target to one of the servers, by its full name or the only one
+// whose name starts with it followed by a dot (e.g. "vdev2" for
+// "vdev2.ad.domain.local"). Returns "" if there is no such server.
+func resolveTargetServer(name string, servers []string) string {
+    var matches []string
+    for _, server := range servers {
+        if server == name {
+            return server
+        }
+        if strings.HasPrefix(server, name + ".") {
+            matches = append(matches, server)
+        }
+    }
+    if len(matches) == 1 {
+        return matches[0]
+    }
+    return ""
+}
+
+// Presents the bastion user as the user of a connection whose username
+// includes a target, to the auth backends, ACLs and rate limits.
+type bastionConnMetadata struct {
+    ssh.ConnMetadata
+    user        string
+}
+
+func (c bastionConnMetadata) User() string {
+    return c.user
+}
+
+func bastionConn(c *SSHConfig, conn ssh.ConnMetadata) ssh.ConnMetadata {
+    target := parseUserTarget(c, conn.User())
+    if target.User == conn.User() {
+        return conn
+    }
+    return bastionConnMetadata{ ConnMetadata: conn, user: target.User }
+}
+
+// The same for an established connection.
+type bastionSSHConn struct {
+    ssh.Conn
+    user        string
+}
+
+func (c bastionSSHConn) User() string {
+    return c.user
+}
@@ -0,0 +1,24 @@
+serial: 1
+serial: 10-20
+serial: 1000
+serial: 1003
+serial: 1006
+serial: 1009
+serial: 1012
+serial: 1015
+serial: 1018
+serial: 1021
+serial: 1024
+serial: 1027
+serial: 1030
+serial: 1033
+serial: 1036
+serial: 1039
+serial: 1042
+serial: 1045
+serial: 1048
+serial: 1051
+serial: 1054
+serial: 1057
+serial: 1060
+id: revoked-id
@@ -0,0 +1,4 @@
+key: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBdi/octhN//P1raDwj0212iVqdE1JQrfiipcB0W2XTe user3
+sha1: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIBTyAReIabH/KKGygkp7A/decEH6+bDASRRf2A2TTVY6 user4
+sha256: ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAILdEWMVWRnLdwgdTb4SaxI3MZTTsSplgp0znlyhqr7wR user5
+hash: SHA256:NDRKep8be8RTtQKXTntCiQEBHIdsxxKKOCf6KwTJKxU
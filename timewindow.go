@@ -0,0 +1,263 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "time"
+    "strconv"
+    "strings"
+    "golang.org/x/crypto/ssh"
+)
+
+// How often open sessions are checked against time windows that end them.
+const timeWindowCheckInterval = 30 * time.Second
+
+var weekdayNames = map[string]time.Weekday{
+    "sun":  time.Sunday,
+    "mon":  time.Monday,
+    "tue":  time.Tuesday,
+    "wed":  time.Wednesday,
+    "thu":  time.Thursday,
+    "fri":  time.Friday,
+    "sat":  time.Saturday,
+}
+
+// A parsed schedule entry, the days it applies to and the minutes of the day
+// it starts and ends at. An end before the start runs past midnight.
+type scheduleEntry struct {
+    days        [7]bool
+    start       int
+    end         int
+}
+
+// Parses a day name, abbreviated to at least three letters (e.g. "Mon",
+// "Tues" or "Wednesday").
+func parseWeekday(name string) (time.Weekday, error) {
+    if len(name) >= 3 {
+        day, ok := weekdayNames[strings.ToLower(name[:3])]
+        if ok && strings.HasPrefix(strings.ToLower(day.String()), strings.ToLower(name)) {
+            return day, nil
+        }
+    }
+    return 0, fmt.Errorf("Invalid day (%s)", name)
+}
+
+// Parses days such as "Mon-Fri", "Sat,Sun" or "Mon-Wed,Fri".
+func parseScheduleDays(spec string, days *[7]bool) error {
+    for _, part := range strings.Split(spec, ",") {
+        bounds := strings.SplitN(part, "-", 2)
+        first, err := parseWeekday(bounds[0])
+        if err != nil {
+            return err
+        }
+        last := first
+        if len(bounds) == 2 {
+            if last, err = parseWeekday(bounds[1]); err != nil {
+                return err
+            }
+        }
+
+        for day := first; ; day = (day + 1) % 7 {
+            days[day] = true
+            if day == last {
+                break
+            }
+        }
+    }
+    return nil
+}
+
+// Parses a time of day, exactly HH:MM, as minutes from midnight. 24:00 is
+// accepted for the end of the day.
+func parseMinuteOfDay(value string) (int, error) {
+    if len(value) != len("15:04") || value[2] != ':' {
+        return 0, fmt.Errorf("Invalid time (%s), expected HH:MM", value)
+    }
+    for _, i := range []int{ 0, 1, 3, 4 } {
+        if value[i] < '0' || value[i] > '9' {
+            return 0, fmt.Errorf("Invalid time (%s), expected HH:MM", value)
+        }
+    }
+
+    hour, _ := strconv.Atoi(value[:2])
+    minute, _ := strconv.Atoi(value[3:])
+    if minute > 59 || hour*60 + minute > 24*60 {
+        return 0, fmt.Errorf("Invalid time (%s), expected HH:MM", value)
+    }
+    return hour*60 + minute, nil
+}
+
+// Parses a schedule entry such as "Mon-Fri 09:00-17:00", "Sat,Sun" (all day)
+// or "22:00-06:00" (every day, overnight).
+func parseScheduleEntry(entry string) (scheduleEntry, error) {
+    e := scheduleEntry{ start: 0, end: 24*60 }
+
+    fields := strings.Fields(entry)
+    if len(fields) == 0 || len(fields) > 2 {
+        return e, fmt.Errorf("Invalid schedule (%s)", entry)
+    }
+
+    daysSet, timesSet := false, false
+    for _, field := range fields {
+        if strings.Contains(field, ":") {
+            if timesSet {
+                return e, fmt.Errorf("Invalid schedule (%s)", entry)
+            }
+            timesSet = true
+            times := strings.SplitN(field, "-", 2)
+            if len(times) != 2 {
+                return e, fmt.Errorf("Invalid schedule times (%s)", field)
+            }
+            var err error
+            if e.start, err = parseMinuteOfDay(times[0]); err != nil {
+                return e, err
+            }
+            if e.end, err = parseMinuteOfDay(times[1]); err != nil {
+                return e, err
+            }
+            if e.start == 24*60 {
+                return e, fmt.Errorf("Invalid schedule times (%s), 24:00 can only end a window", field)
+            }
+            if e.start == e.end {
+                return e, fmt.Errorf("Invalid schedule times (%s), the window is empty", field)
+            }
+        } else {
+            if daysSet {
+                return e, fmt.Errorf("Invalid schedule (%s)", entry)
+            }
+            if err := parseScheduleDays(field, &e.days); err != nil {
+                return e, err
+            }
+            daysSet = true
+        }
+    }
+
+    if ! daysSet {
+        for day := range e.days {
+            e.days[day] = true
+        }
+    }
+
+    return e, nil
+}
+
+func (e scheduleEntry) activeAt(t time.Time) bool {
+    minute := t.Hour()*60 + t.Minute()
+    day := t.Weekday()
+
+    if e.start < e.end {
+        return e.days[day] && minute >= e.start && minute < e.end
+    }
+
+    // Past midnight, the early hours belong to the window of the day before.
+    return ( e.days[day] && minute >= e.start ) || ( e.days[(day+6)%7] && minute < e.end )
+}
+
+func (w SSHConfigTimeWindow) location() (*time.Location, error) {
+    if len(w.TimeZone) == 0 {
+        return time.Local, nil
+    }
+    loc, err := time.LoadLocation(w.TimeZone)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid time_zone (%s): %s", w.TimeZone, err)
+    }
+    return loc, nil
+}
+
+// Parses a valid_from / valid_until time, either RFC 3339 or a date with an
+// optional time in the window's time zone.
+func parseWindowTime(value string, loc *time.Location) (time.Time, error) {
+    if t, err := time.Parse(time.RFC3339, value); err == nil {
+        return t, nil
+    }
+    for _, layout := range []string{ "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02" } {
+        if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+            return t, nil
+        }
+    }
+    return time.Time{}, fmt.Errorf("Invalid time (%s), expected YYYY-MM-DD [HH:MM] or RFC 3339", value)
+}
+
+// Returns an error if the window isn't open at the time, including if it
+// can't be parsed, so that a broken window denies access.
+func (w SSHConfigTimeWindow) checkAt(t time.Time) error {
+    loc, err := w.location()
+    if err != nil {
+        return err
+    }
+    t = t.In(loc)
+
+    if len(w.ValidFrom) > 0 {
+        from, err := parseWindowTime(w.ValidFrom, loc)
+        if err != nil {
+            return err
+        }
+        if t.Before(from) {
+            return fmt.Errorf("Not valid until %s", from.Format(time.RFC3339))
+        }
+    }
+
+    if len(w.ValidUntil) > 0 {
+        until, err := parseWindowTime(w.ValidUntil, loc)
+        if err != nil {
+            return err
+        }
+        // A date alone includes the whole of that day.
+        if len(w.ValidUntil) == len("2006-01-02") {
+            until = until.AddDate(0, 0, 1)
+        }
+        if ! t.Before(until) {
+            return fmt.Errorf("Expired at %s", until.Format(time.RFC3339))
+        }
+    }
+
+    if len(w.Schedule) == 0 {
+        return nil
+    }
+    for _, entry := range w.Schedule {
+        e, err := parseScheduleEntry(entry)
+        if err != nil {
+            return err
+        }
+        if e.activeAt(t) {
+            return nil
+        }
+    }
+    return fmt.Errorf("Outside of schedule")
+}
+
+// Returns whether a session to the server should be ended when it is no
+// longer permitted, as the user or an ACL allowing the server has end_sessions set.
+func endsSessions(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions, server string) bool {
+    if user, ok := c.Users[conn.User()]; ok && user.EndSessions {
+        return true
+    }
+    for _, name := range grantedACLs(c, conn.User(), perm) {
+        if acl, ok := c.ACLs[name]; ok && acl.EndSessions && containsString(aclServers(c, acl), server) {
+            return true
+        }
+    }
+    return false
+}
+
+// Ends the session once its time windows no longer permit the server,
+// checking until done is closed.
+func watchSessionWindow(c *SSHConfig, sshConn *ssh.ServerConn, server string, w io.Writer, done <-chan struct{}) {
+    ticker := time.NewTicker(timeWindowCheckInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+            case <-done:
+                return
+            case <-ticker.C:
+                if allowed, _ := permittedServers(c, sshConn, sshConn.Permissions); containsString(allowed, server) {
+                    continue
+                }
+                WriteAuthLog("Ending session to %s for user %s from %s as its time window has closed.", server, sshConn.User(), sshConn.RemoteAddr())
+                fmt.Fprintf(w, "\r\nAccess window has closed, ending session.\r\n")
+                sshConn.Close()
+                return
+        }
+    }
+}
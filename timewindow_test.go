@@ -0,0 +1,108 @@
+package main
+
+import (
+    "time"
+    "testing"
+)
+
+func TestParseScheduleEntry(t *testing.T) {
+    weekdays := [7]bool{ false, true, true, true, true, true, false }
+
+    for _, test := range []struct {
+        entry       string
+        days        [7]bool
+        start, end  int
+    }{
+        { "Mon-Fri 09:00-17:00", weekdays, 9*60, 17*60 },
+        { "09:00-17:00 Monday-Friday", weekdays, 9*60, 17*60 },
+        { "Sat,Sun", [7]bool{ true, false, false, false, false, false, true }, 0, 24*60 },
+        { "Fri-Mon", [7]bool{ true, true, false, false, false, true, true }, 0, 24*60 },
+        { "Tues,Thu 00:00-24:00", [7]bool{ false, false, true, false, true, false, false }, 0, 24*60 },
+        { "22:00-06:30", [7]bool{ true, true, true, true, true, true, true }, 22*60, 6*60 + 30 },
+    } {
+        e, err := parseScheduleEntry(test.entry)
+        if err != nil {
+            t.Errorf("%s: %s", test.entry, err)
+            continue
+        }
+        if e.days != test.days || e.start != test.start || e.end != test.end {
+            t.Errorf("%s: unexpected %+v", test.entry, e)
+        }
+    }
+}
+
+func TestParseScheduleEntryInvalid(t *testing.T) {
+    for _, entry := range []string{
+        "",
+        "Mon 9:00-10:00",
+        "Mon 09:00x-10:00",
+        "Mon 09:00-10:00x",
+        "Mon 09:0-10:00",
+        "Mon +9:00-10:00",
+        "Mon 09:60-10:00",
+        "Mon 25:00-26:00",
+        "Mon 24:00-06:00",
+        "Mon 24:01-06:00",
+        "Mon 09:00-09:00",
+        "Mon 09:00",
+        "Mon 09:00-10:00 11:00-12:00",
+        "Mon Tue",
+        "Mo 09:00-10:00",
+        "Monx 09:00-10:00",
+        "Mon-Funday",
+        "Mon 09:00-17:00 extra",
+    } {
+        if _, err := parseScheduleEntry(entry); err == nil {
+            t.Errorf("%q: expected an error", entry)
+        }
+    }
+}
+
+func TestTimeWindowCheckAt(t *testing.T) {
+    utc := func(s string) time.Time {
+        v, err := time.Parse("2006-01-02 15:04", s)
+        if err != nil {
+            t.Fatal(err)
+        }
+        return v
+    }
+
+    // 2026-10-19 is a Monday.
+    for _, test := range []struct {
+        window      SSHConfigTimeWindow
+        at          string
+        open        bool
+    }{
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon-Fri 09:00-17:00" } }, "2026-10-19 09:00", true },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon-Fri 09:00-17:00" } }, "2026-10-19 16:59", true },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon-Fri 09:00-17:00" } }, "2026-10-19 17:00", false },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon-Fri 09:00-17:00" } }, "2026-10-18 12:00", false },
+        // Overnight windows run into the next day's early hours.
+        { SSHConfigTimeWindow{ Schedule: []string{ "Fri 22:00-06:00" } }, "2026-10-23 23:00", true },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Fri 22:00-06:00" } }, "2026-10-24 05:59", true },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Fri 22:00-06:00" } }, "2026-10-24 06:00", false },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Fri 22:00-06:00" } }, "2026-10-23 05:00", false },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Sat,Sun", "Mon 00:00-01:00" } }, "2026-10-19 00:30", true },
+        // The schedule is evaluated in the window's time zone.
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon 09:00-10:00" }, TimeZone: "America/New_York" }, "2026-10-19 13:30", true },
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon 09:00-10:00" }, TimeZone: "America/New_York" }, "2026-10-19 09:30", false },
+        { SSHConfigTimeWindow{ ValidFrom: "2026-10-19", TimeZone: "UTC" }, "2026-10-18 23:59", false },
+        { SSHConfigTimeWindow{ ValidFrom: "2026-10-19", TimeZone: "UTC" }, "2026-10-19 00:00", true },
+        // A date alone for valid_until includes that day.
+        { SSHConfigTimeWindow{ ValidUntil: "2026-10-19", TimeZone: "UTC" }, "2026-10-19 23:59", true },
+        { SSHConfigTimeWindow{ ValidUntil: "2026-10-19", TimeZone: "UTC" }, "2026-10-20 00:00", false },
+        { SSHConfigTimeWindow{ ValidUntil: "2026-10-19T12:00:00Z" }, "2026-10-19 12:00", false },
+        // A window that can't be parsed is never open.
+        { SSHConfigTimeWindow{ Schedule: []string{ "Mon 09:00-09:00" } }, "2026-10-19 09:00", false },
+        { SSHConfigTimeWindow{ TimeZone: "Nowhere/Special" }, "2026-10-19 09:00", false },
+        { SSHConfigTimeWindow{}, "2026-10-19 09:00", true },
+    } {
+        w := test.window
+        if len(w.TimeZone) == 0 && len(w.ValidUntil) == 0 {
+            w.TimeZone = "UTC"
+        }
+        if err := w.checkAt(utc(test.at)); ( err == nil ) != test.open {
+            t.Errorf("%+v at %s: expected open %v, got %v", test.window, test.at, test.open, err)
+        }
+    }
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+    "os"
+    "fmt"
+    "log"
+    "sync"
+    "time"
+    "strings"
+    "net/url"
+    "io/ioutil"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha1"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/binary"
+    "golang.org/x/crypto/ssh"
+    "gopkg.in/yaml.v2"
+)
+
+const (
+    totpPeriod      = 30
+    totpDigits      = 6
+    // Number of periods either side of now to accept, to allow for clock drift.
+    totpSkew        = 1
+)
+
+var totpLastStep = map[string]int64{}
+var totpMutex = &sync.Mutex{}
+
+func decodeTOTPSecret(secret string) ([]byte, error) {
+    secret = strings.ToUpper(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+    secret = strings.TrimRight(secret, "=")
+    return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// Generates the RFC 6238 code (HMAC-SHA1, 6 digits) for a time step.
+func totpCode(key []byte, step int64) string {
+    msg := make([]byte, 8)
+    binary.BigEndian.PutUint64(msg, uint64(step))
+
+    mac := hmac.New(sha1.New, key)
+    mac.Write(msg)
+    sum := mac.Sum(nil)
+
+    offset := sum[len(sum)-1] & 0x0f
+    code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+    return fmt.Sprintf("%0*d", totpDigits, code % 1000000)
+}
+
+// Validates a code against the secret, rejecting reuse of a code that has
+// already been accepted for the user.
+func validateTOTP(username string, secret string, code string) bool {
+    return validateTOTPAt(username, secret, code, time.Now())
+}
+
+func validateTOTPAt(username string, secret string, code string, t time.Time) bool {
+    key, err := decodeTOTPSecret(secret)
+    if err != nil {
+        log.Printf("Invalid TOTP secret for user (%s): %s", username, err)
+        return false
+    }
+
+    code = strings.TrimSpace(code)
+    now := t.Unix() / totpPeriod
+
+    totpMutex.Lock()
+    defer totpMutex.Unlock()
+
+    for step := now - totpSkew; step <= now + totpSkew; step++ {
+        if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+            if step <= totpLastStep[username] {
+                log.Printf("Replayed TOTP code rejected for user (%s)", username)
+                return false
+            }
+            totpLastStep[username] = step
+            return true
+        }
+    }
+
+    return false
+}
+
+func readTOTPSecretsFile(filename string) (map[string]string, error) {
+    secrets := map[string]string{}
+
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        if os.IsNotExist(err) {
+            return secrets, nil
+        }
+        return nil, fmt.Errorf("Unable to read TOTP secrets file (%s): %s", filename, err)
+    }
+
+    if err := yaml.Unmarshal(data, &secrets); err != nil {
+        return nil, fmt.Errorf("Unable to parse TOTP secrets file (%s): %s", filename, err)
+    }
+
+    return secrets, nil
+}
+
+// Returns the TOTP secret for a user, from the user config or the secrets file.
+func userTOTPSecret(c *SSHConfig, username string) string {
+    if user, ok := c.Users[username]; ok && len(user.TOTPSecret) > 0 {
+        return user.TOTPSecret
+    }
+
+    if len(c.Global.TOTPSecretsFile) > 0 {
+        secrets, err := readTOTPSecretsFile(c.Global.TOTPSecretsFile)
+        if err != nil {
+            log.Printf("%s", err)
+            return ""
+        }
+        return secrets[username]
+    }
+
+    return ""
+}
+
+func totpRequired(c *SSHConfig, username string) bool {
+    if c.Global.RequireTOTP {
+        return true
+    }
+    user, ok := c.Users[username]
+    return ok && user.RequireTOTP
+}
+
+// Prompts for a verification code via keyboard-interactive auth, returning
+// the permissions granted by the first factor if it is valid.
+func totpChallenge(c *SSHConfig, conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge, perm *ssh.Permissions) (*ssh.Permissions, error) {
+    secret := userTOTPSecret(c, conn.User())
+
+    for i := 0; i < 3; i++ {
+        answers, err := client("", "", []string{ "Verification code: " }, []bool{ false })
+        if err != nil {
+            return nil, err
+        }
+
+        if len(secret) > 0 && len(answers) == 1 && validateTOTP(conn.User(), secret, answers[0]) {
+            perm.Extensions["totp"] = "true"
+            return perm, nil
+        }
+    }
+
+    if len(secret) == 0 {
+        log.Printf("TOTP required but no secret enrolled for user (%s)", conn.User())
+    }
+
+    return nil, fmt.Errorf("Invalid TOTP Verification Code")
+}
+
+// Requires a TOTP code as a second factor after a successful first factor,
+// for users that have TOTP enforced.
+func withTOTP(c *SSHConfig, conn ssh.ConnMetadata, perm *ssh.Permissions, err error) (*ssh.Permissions, error) {
+    if err != nil || ! totpRequired(c, conn.User()) {
+        return perm, err
+    }
+
+    // Already verified in an earlier step.
+    if perm.Extensions["totp"] == "true" {
+        return perm, nil
+    }
+
+    return nil, &ssh.PartialSuccessError{
+        Next: ssh.ServerAuthCallbacks{
+            KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+                return totpChallenge(c, bastionConn(c, conn), client, perm)
+            },
+        },
+    }
+}
+
+type totpEnrollCommand struct {
+    User        string      `short:"u" long:"user" description:"Username to enroll" required:"true"`
+    Issuer      string      `short:"i" long:"issuer" description:"Issuer shown in the authenticator app" default:"SSH Bastion"`
+}
+
+// Generates a new secret for a user, storing it in the TOTP secrets file if
+// one is configured, and prints the provisioning URI.
+func (c *totpEnrollCommand) Execute(args []string) error {
+    if err := loadConfig(); err != nil {
+        return err
+    }
+
+    raw := make([]byte, 20)
+    if _, err := rand.Read(raw); err != nil {
+        return err
+    }
+    secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+    if len(getConfig().Global.TOTPSecretsFile) > 0 {
+        secrets, err := readTOTPSecretsFile(getConfig().Global.TOTPSecretsFile)
+        if err != nil {
+            return err
+        }
+        secrets[c.User] = secret
+
+        data, err := yaml.Marshal(secrets)
+        if err != nil {
+            return err
+        }
+        if err := ioutil.WriteFile(getConfig().Global.TOTPSecretsFile, data, 0600); err != nil {
+            return fmt.Errorf("Unable to write TOTP secrets file (%s): %s", getConfig().Global.TOTPSecretsFile, err)
+        }
+        fmt.Printf("Secret for %s stored in %s\n", c.User, getConfig().Global.TOTPSecretsFile)
+    } else {
+        fmt.Printf("Add the following to the config for user %s:\n    totp_secret: \"%s\"\n", c.User, secret)
+    }
+
+    label := url.PathEscape(fmt.Sprintf("%s:%s", c.Issuer, c.User))
+    params := url.Values{}
+    params.Set("secret", secret)
+    params.Set("issuer", c.Issuer)
+    params.Set("algorithm", "SHA1")
+    params.Set("digits", fmt.Sprintf("%d", totpDigits))
+    params.Set("period", fmt.Sprintf("%d", totpPeriod))
+
+    fmt.Printf("otpauth://totp/%s?%s\n", label, params.Encode())
+
+    return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+    "time"
+    "testing"
+    "encoding/base32"
+)
+
+// The SHA1 test vectors from RFC 6238 appendix B, which are 8 digits, of
+// which the last 6 are the 6 digit code.
+func TestTOTPCode(t *testing.T) {
+    key := []byte("12345678901234567890")
+
+    for _, test := range []struct {
+        time        int64
+        code        string
+    }{
+        { 59, "287082" },
+        { 1111111109, "081804" },
+        { 1111111111, "050471" },
+        { 1234567890, "005924" },
+        { 2000000000, "279037" },
+        { 20000000000, "353130" },
+    } {
+        if code := totpCode(key, test.time / totpPeriod); code != test.code {
+            t.Errorf("Time %d (step %d): expected %s, got %s", test.time, test.time / totpPeriod, test.code, code)
+        }
+    }
+}
+
+func TestDecodeTOTPSecret(t *testing.T) {
+    for _, secret := range []string{
+        "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+        "gezd gnbv gy3t qojq gezd gnbv gy3t qojq",
+        " GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ====\n",
+    } {
+        key, err := decodeTOTPSecret(secret)
+        if err != nil || string(key) != "12345678901234567890" {
+            t.Errorf("%q: unexpected %q, %v", secret, key, err)
+        }
+    }
+    if _, err := decodeTOTPSecret("not base32!"); err == nil {
+        t.Errorf("Expected an invalid secret to fail")
+    }
+}
+
+func testTOTPSecret() (string, []byte) {
+    key := []byte("12345678901234567890")
+    return base32.StdEncoding.EncodeToString(key), key
+}
+
+func TestValidateTOTPSkew(t *testing.T) {
+    secret, key := testTOTPSecret()
+    now := time.Unix(1234567890, 0)
+    step := now.Unix() / totpPeriod
+
+    // Each code is checked for its own user, so none are replays.
+    for offset, valid := range map[int64]bool{ -2: false, -1: true, 0: true, 1: true, 2: false } {
+        username := "skew" + string(rune('c' + offset))
+        if validateTOTPAt(username, secret, totpCode(key, step + offset), now) != valid {
+            t.Errorf("Code %d step(s) from now: expected valid %v", offset, valid)
+        }
+    }
+
+    if validateTOTPAt("skew-wrong", secret, "000000", now) {
+        t.Errorf("Expected a wrong code to be rejected")
+    }
+    if validateTOTPAt("skew-invalid", "not base32!", totpCode(key, step), now) {
+        t.Errorf("Expected an invalid secret to reject every code")
+    }
+}
+
+func TestValidateTOTPReuse(t *testing.T) {
+    secret, key := testTOTPSecret()
+    now := time.Unix(1234567890, 0)
+    step := now.Unix() / totpPeriod
+
+    if ! validateTOTPAt("reuse", secret, totpCode(key, step), now) {
+        t.Fatalf("Expected the current code to be accepted")
+    }
+    if validateTOTPAt("reuse", secret, totpCode(key, step), now) {
+        t.Errorf("Expected the same code to be rejected a second time")
+    }
+    // Still within the skew, but older than the code already used.
+    if validateTOTPAt("reuse", secret, totpCode(key, step - 1), now) {
+        t.Errorf("Expected an earlier code to be rejected after a later one was used")
+    }
+    if ! validateTOTPAt("reuse-other", secret, totpCode(key, step), now) {
+        t.Errorf("Expected another user to be able to use the same code")
+    }
+
+    // The next period's code is accepted, then the one after that once it's current.
+    if ! validateTOTPAt("reuse", secret, totpCode(key, step + 1), now) {
+        t.Errorf("Expected the next code to be accepted")
+    }
+    later := now.Add(2 * totpPeriod * time.Second)
+    if ! validateTOTPAt("reuse", secret, " " + totpCode(key, step + 2) + " ", later) {
+        t.Errorf("Expected a later code (with spaces) to be accepted")
+    }
+}
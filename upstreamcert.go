@@ -0,0 +1,89 @@
+package main
+
+import (
+    "fmt"
+    "time"
+    "math/big"
+    "io/ioutil"
+    "crypto/rand"
+    "crypto/ed25519"
+    "golang.org/x/crypto/ssh"
+)
+
+const defaultUpstreamCertValidity = 5 * time.Minute
+
+func upstreamCertValidity(c *SSHConfig) (time.Duration, error) {
+    if len(c.Global.UpstreamCertValidity) == 0 {
+        return defaultUpstreamCertValidity, nil
+    }
+
+    validity, err := time.ParseDuration(c.Global.UpstreamCertValidity)
+    if err != nil {
+        return 0, fmt.Errorf("Invalid upstream_cert_validity (%s): %s", c.Global.UpstreamCertValidity, err)
+    }
+    return validity, nil
+}
+
+// Issues a short-lived certificate for a fresh key, with the remote login user
+// as the only principal, signed by the upstream CA key. The remote server then
+// only needs to trust the CA (TrustedUserCAKeys), and no user credentials
+// have to be passed through the relay.
+func MintUpstreamCert(c *SSHConfig, loginUser string, bastionUser string, remoteName string) (ssh.Signer, *ssh.Certificate, error) {
+    caData, err := ioutil.ReadFile(c.Global.UpstreamCAKey)
+    if err != nil {
+        return nil, nil, fmt.Errorf("Unable to read upstream CA key (%s): %s", c.Global.UpstreamCAKey, err)
+    }
+
+    caSigner, err := ssh.ParsePrivateKey(caData)
+    if err != nil {
+        return nil, nil, fmt.Errorf("Invalid upstream CA key (%s): %s", c.Global.UpstreamCAKey, err)
+    }
+
+    validity, err := upstreamCertValidity(c)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    _, sessionKey, err := ed25519.GenerateKey(rand.Reader)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    signer, err := ssh.NewSignerFromKey(sessionKey)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    serial, err := rand.Int(rand.Reader, new(big.Int).SetUint64(^uint64(0)))
+    if err != nil {
+        return nil, nil, err
+    }
+
+    now := time.Now()
+    cert := &ssh.Certificate{
+        Key:                signer.PublicKey(),
+        Serial:             serial.Uint64(),
+        CertType:           ssh.UserCert,
+        KeyId:              fmt.Sprintf("ssh-bastion:%s:%s@%s", bastionUser, loginUser, remoteName),
+        ValidPrincipals:    []string{ loginUser },
+        // Allow for a little clock skew between the relay and the remote.
+        ValidAfter:         uint64(now.Add(-1 * time.Minute).Unix()),
+        ValidBefore:        uint64(now.Add(validity).Unix()),
+        Permissions:        ssh.Permissions{
+            Extensions:         map[string]string{
+                "permit-pty":       "",
+            },
+        },
+    }
+
+    if err := cert.SignCert(rand.Reader, caSigner); err != nil {
+        return nil, nil, fmt.Errorf("Unable to sign upstream certificate: %s", err)
+    }
+
+    certSigner, err := ssh.NewCertSigner(cert, signer)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    return certSigner, cert, nil
+}
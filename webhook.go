@@ -0,0 +1,216 @@
+package main
+
+import (
+    "io"
+    "fmt"
+    "log"
+    "time"
+    "bytes"
+    "context"
+    "strconv"
+    "strings"
+    "net"
+    "net/url"
+    "net/http"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "golang.org/x/crypto/ssh"
+)
+
+const defaultWebhookTimeout = 5 * time.Second
+
+// Largest webhook reply that will be read.
+const maxWebhookResponse = 1 << 20
+
+type webhookRequest struct {
+    User            string      `json:"user"`
+    Method          string      `json:"method"`
+    Password        string      `json:"password,omitempty"`
+    KeyType         string      `json:"key_type,omitempty"`
+    KeyFingerprint  string      `json:"key_fingerprint,omitempty"`
+    SourceAddress   string      `json:"source_address"`
+}
+
+type webhookResponse struct {
+    Allow           bool        `json:"allow"`
+    AllowedServers  []string    `json:"allowed_servers"`
+    LoginUser       string      `json:"login_user"`
+    Message         string      `json:"message"`
+}
+
+// Redirects aren't followed, so that a reply can't send the password (or the
+// signed request) on to another URL.
+var webhookClient = &http.Client{
+    CheckRedirect: func(req *http.Request, via []*http.Request) error {
+        return fmt.Errorf("Webhook redirect to %s not followed", req.URL)
+    },
+}
+
+// Requires an https webhook_url, as requests carry passwords. Plain http is
+// only allowed to the loopback address (e.g. a broker on the same host).
+func checkWebhookURL(rawURL string) error {
+    u, err := url.Parse(rawURL)
+    if err != nil {
+        return err
+    }
+
+    switch u.Scheme {
+        case "https":
+            return nil
+        case "http":
+            if ip := net.ParseIP(u.Hostname()); u.Hostname() == "localhost" || ( ip != nil && ip.IsLoopback() ) {
+                return nil
+            }
+            return fmt.Errorf("http is only allowed to the loopback address, use https")
+        default:
+            return fmt.Errorf("unsupported scheme (%s), use https", u.Scheme)
+    }
+}
+
+// Signs the timestamp and body with HMAC-SHA256, so the receiver can verify
+// the request came from the bastion and reject replays of old requests.
+func webhookSignature(secret string, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp + "."))
+    mac.Write(body)
+    return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// POSTs the request to the webhook_url, any failure to get a valid reply
+// is returned as an error so the caller can deny access.
+func callWebhook(c *SSHConfig, r *webhookRequest) (*webhookResponse, error) {
+    if err := checkWebhookURL(c.Global.WebhookURL); err != nil {
+        return nil, fmt.Errorf("Invalid webhook_url (%s): %s", c.Global.WebhookURL, err)
+    }
+
+    timeout, err := parseDurationOption("webhook_timeout", c.Global.WebhookTimeout, defaultWebhookTimeout)
+    if err != nil {
+        return nil, err
+    }
+
+    body, err := json.Marshal(r)
+    if err != nil {
+        return nil, err
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), timeout)
+    defer cancel()
+
+    req, err := http.NewRequest("POST", c.Global.WebhookURL, bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req = req.WithContext(ctx)
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("User-Agent", "ssh-bastion")
+
+    if len(c.Global.WebhookSecret) > 0 {
+        timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+        req.Header.Set("X-Bastion-Timestamp", timestamp)
+        req.Header.Set("X-Bastion-Signature", webhookSignature(c.Global.WebhookSecret, timestamp, body))
+    }
+
+    resp, err := webhookClient.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+    }
+
+    reply := &webhookResponse{}
+    if err := json.NewDecoder(io.LimitReader(resp.Body, maxWebhookResponse)).Decode(reply); err != nil {
+        return nil, fmt.Errorf("Invalid webhook reply: %s", err)
+    }
+
+    return reply, nil
+}
+
+// Converts a webhook reply into ssh.Permissions extensions, the servers
+// granted (in addition to any ACLs) and the login user for the remote.
+func webhookExtensions(username string, reply *webhookResponse) (map[string]string, error) {
+    if ! reply.Allow {
+        if len(reply.Message) > 0 {
+            log.Printf("Webhook denied user (%s): %s", username, reply.Message)
+        }
+        return nil, fmt.Errorf("Webhook Denied Access")
+    }
+
+    extensions := map[string]string{}
+    if len(reply.AllowedServers) > 0 {
+        extensions["allowed_servers"] = strings.Join(reply.AllowedServers, ",")
+    }
+    if len(reply.LoginUser) > 0 {
+        extensions["login_user"] = reply.LoginUser
+    }
+
+    return extensions, nil
+}
+
+// Returns whether a webhook_url is set, globally or for a webhook backend.
+func webhookConfigured(c *SSHConfig) bool {
+    if len(c.Global.WebhookURL) > 0 {
+        return true
+    }
+    for _, backend := range c.Global.AuthType {
+        if bc, err := backendConfig(c, backend); err == nil && backend.Type == "webhook" && len(bc.Global.WebhookURL) > 0 {
+            return true
+        }
+    }
+    return false
+}
+
+func init() {
+    RegisterAuthenticator("webhook", AuthenticatorFunc(authWebhook))
+}
+
+// Asks the webhook to check the user's password.
+func authWebhook(c *SSHConfig, conn ssh.ConnMetadata, password []byte) (map[string]string, error) {
+    reply, err := callWebhook(c, &webhookRequest{
+        User:           conn.User(),
+        Method:         "password",
+        Password:       string(password),
+        SourceAddress:  remoteIP(conn.RemoteAddr()),
+    })
+    if err != nil {
+        log.Printf("Webhook Auth Failed for user (%s): %s", conn.User(), err)
+        return nil, fmt.Errorf("Webhook Auth Failed")
+    }
+
+    return webhookExtensions(conn.User(), reply)
+}
+
+// Asks the webhook whether a public key not accepted by the config may be
+// used by the user.
+func authWebhookPublicKey(c *SSHConfig, conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+    reply, err := callWebhook(c, &webhookRequest{
+        User:           conn.User(),
+        Method:         "publickey",
+        KeyType:        key.Type(),
+        KeyFingerprint: ssh.FingerprintSHA256(key),
+        SourceAddress:  remoteIP(conn.RemoteAddr()),
+    })
+    if err != nil {
+        log.Printf("Webhook Auth Failed for user (%s): %s", conn.User(), err)
+        return nil, fmt.Errorf("Webhook Auth Failed")
+    }
+
+    extensions, err := webhookExtensions(conn.User(), reply)
+    if err != nil {
+        return nil, err
+    }
+
+    if _, known := c.Users[conn.User()]; ! known && len(extensions["allowed_servers"]) == 0 {
+        return nil, fmt.Errorf("User Doesn't Exist in Config and No Servers Allowed")
+    }
+
+    extensions["authType"] = "pk"
+    return &ssh.Permissions{
+        CriticalOptions:    map[string]string{},
+        Extensions:         extensions,
+    }, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+    "io"
+    "time"
+    "testing"
+    "net/http"
+    "io/ioutil"
+    "encoding/json"
+    "net/http/httptest"
+)
+
+// Starts a TLS webhook receiver and returns a config pointing at it. The
+// webhook client trusts the receiver's certificate until the test ends.
+func newTestWebhook(t *testing.T, handler http.HandlerFunc) (*SSHConfig, *httptest.Server) {
+    server := httptest.NewTLSServer(handler)
+    transport := webhookClient.Transport
+    webhookClient.Transport = server.Client().Transport
+    t.Cleanup(func() {
+        webhookClient.Transport = transport
+        server.Close()
+    })
+
+    c := &SSHConfig{ Users: map[string]SSHConfigUser{} }
+    c.Global.WebhookURL = server.URL + "/auth"
+    c.Global.WebhookSecret = "shared-secret"
+    c.Global.WebhookTimeout = "200ms"
+    return c, server
+}
+
+func TestWebhookSignature(t *testing.T) {
+    c, _ := newTestWebhook(t, func(w http.ResponseWriter, r *http.Request) {
+        body, _ := ioutil.ReadAll(r.Body)
+        timestamp := r.Header.Get("X-Bastion-Timestamp")
+        if r.Header.Get("X-Bastion-Signature") != webhookSignature("shared-secret", timestamp, body) {
+            http.Error(w, "bad signature", http.StatusForbidden)
+            return
+        }
+
+        var req webhookRequest
+        if err := json.Unmarshal(body, &req); err != nil || req.User != "alice" || req.Password != "secret" {
+            http.Error(w, "bad request", http.StatusBadRequest)
+            return
+        }
+        io.WriteString(w, `{"allow": true, "allowed_servers": ["vdev1", "vdev2"], "login_user": "deploy"}`)
+    })
+
+    extensions, err := authWebhook(c, testConnMetadata{ user: "alice" }, []byte("secret"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if extensions["allowed_servers"] != "vdev1,vdev2" || extensions["login_user"] != "deploy" {
+        t.Errorf("Unexpected extensions %v", extensions)
+    }
+}
+
+// Anything but a valid reply allowing the user denies access.
+func TestWebhookFailsClosed(t *testing.T) {
+    for name, handler := range map[string]http.HandlerFunc{
+        "timeout":          func(w http.ResponseWriter, r *http.Request) {
+            // The request is cancelled once the body has been read.
+            ioutil.ReadAll(r.Body)
+            select {
+                case <-r.Context().Done():
+                case <-time.After(5 * time.Second):
+            }
+            io.WriteString(w, `{"allow": true}`)
+        },
+        "non-200":          func(w http.ResponseWriter, r *http.Request) {
+            w.WriteHeader(http.StatusInternalServerError)
+            io.WriteString(w, `{"allow": true}`)
+        },
+        "malformed json":   func(w http.ResponseWriter, r *http.Request) {
+            io.WriteString(w, `{"allow": tru`)
+        },
+        "allow false":      func(w http.ResponseWriter, r *http.Request) {
+            io.WriteString(w, `{"allow": false, "message": "outside change window"}`)
+        },
+        "redirect":         func(w http.ResponseWriter, r *http.Request) {
+            if r.URL.Path == "/auth" {
+                http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+                return
+            }
+            io.WriteString(w, `{"allow": true}`)
+        },
+    } {
+        t.Run(name, func(t *testing.T) {
+            c, _ := newTestWebhook(t, handler)
+            if extensions, err := authWebhook(c, testConnMetadata{ user: "alice" }, []byte("secret")); err == nil {
+                t.Errorf("Expected access to be denied, got %v", extensions)
+            }
+        })
+    }
+}
+
+func TestCheckWebhookURL(t *testing.T) {
+    for rawURL, ok := range map[string]bool{
+        "https://broker.domain.local/ssh/auth": true,
+        "http://127.0.0.1:8080/auth":           true,
+        "http://localhost/auth":                true,
+        "http://[::1]/auth":                    true,
+        "http://broker.domain.local/ssh/auth":  false,
+        "ftp://broker.domain.local/":           false,
+        "broker.domain.local":                  false,
+    } {
+        if err := checkWebhookURL(rawURL); ( err == nil ) != ok {
+            t.Errorf("%s: unexpected result %v", rawURL, err)
+        }
+    }
+}
+
+func TestWebhookRefusesPlainHTTP(t *testing.T) {
+    c := &SSHConfig{}
+    c.Global.WebhookURL = "http://broker.domain.local/ssh/auth"
+    if _, err := callWebhook(c, &webhookRequest{ User: "alice" }); err == nil {
+        t.Errorf("Expected a plain http webhook_url to be refused")
+    }
+}